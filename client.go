@@ -3,9 +3,31 @@ package main
 import "C"
 import (
 	"bean/client"
+	"bean/common"
+	"flag"
+	"fmt"
+	"os"
 )
 
 func main() {
-	beanClient := client.NewClientApplication()
+	configPath := flag.String("c", client.DefaultConfigPath, "client config file")
+	version := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+	if *version {
+		fmt.Printf("bean client %s protocol %d \r\n", common.BuildVersion, common.ProtocolVersion)
+		return
+	}
+	beanClient, err := client.NewClientApplication(*configPath)
+	if err != nil {
+		if configErr, ok := err.(*client.ConfigError); ok {
+			fmt.Printf("invalid client config %s: \r\n", *configPath)
+			for _, problem := range configErr.Problems {
+				fmt.Printf("  - %s \r\n", problem)
+			}
+		} else {
+			fmt.Printf("%v \r\n", err)
+		}
+		os.Exit(1)
+	}
 	beanClient.Run()
 }
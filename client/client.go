@@ -2,30 +2,57 @@ package client
 
 import (
 	"bean/common"
-	"net"
 )
 
 type BeanClientConfig struct {
-	ServerAddr  string                  `json:"server_addr"`
-	ServiceList []BeanClientServiceItem `json:"service_list"`
+	ServerAddr    string                  `json:"server_addr"`
+	ClientId      string                  `json:"client_id"`
+	ClientIdFile  string                  `json:"client_id_file"`
+	ClientSecret  string                  `json:"client_secret"`
+	User          string                  `json:"user"`
+	Token         string                  `json:"token"`
+	ResumeTimeout int                     `json:"resume_timeout"`
+	ServiceList   []BeanClientServiceItem `json:"service_list"`
+
+	TLSEnable             bool     `json:"tls_enable"`
+	TLSCAFile             string   `json:"tls_ca_file"`
+	TLSServerName         string   `json:"tls_server_name"`
+	TLSInsecureSkipVerify bool     `json:"tls_insecure_skip_verify"`
+	TLSPinSHA256          []string `json:"tls_pin_sha256"`
+	TLSCertFile           string   `json:"tls_cert_file"`
+	TLSKeyFile            string   `json:"tls_key_file"`
+
+	PSK           string `json:"psk"`
+	PSKRekeyBytes int64  `json:"psk_rekey_bytes"`
 }
 
 type BeanClientServiceItem struct {
-	Name       string `json:"name"`
-	RemotePort int    `json:"remote_port"`
-	LocalAddr  string `json:"local_addr"`
+	Name          string            `json:"name"`
+	Protocol      string            `json:"protocol"`
+	RemotePort    common.PortRange  `json:"remote_port"`
+	Domains       []string          `json:"domains"`
+	LocalAddr     string            `json:"local_addr"`
+	Compression   string            `json:"compression"`
+	ProxyProtocol string            `json:"proxy_protocol"`
+	AllowIPs      []string          `json:"allow_ips"`
+	DenyIPs       []string          `json:"deny_ips"`
+	RateLimit     *common.RateLimit `json:"rate_limit"`
+	ConnLimit     *common.ConnLimit `json:"conn_limit"`
 }
 
-func NewClientApplication() *BeanClient {
+func NewClientApplication(configPath string) (*BeanClient, error) {
 	client := &BeanClient{
-		ProxyMap:      make(map[string]net.Conn),
+		ProxyMap:      make(map[string]*ProxyConn),
+		StreamMap:     make(map[uint32]*ProxyConn),
+		Stats:         make(map[string]*common.CompressionStats),
+		Shapers:       make(map[string]*common.Shaper),
 		ServiceConfig: make(map[string]BeanClientServiceItem),
+		ServiceState:  make(map[string]common.ServiceStatus),
 		CloseSign:     make(chan bool),
 		RestartSign:   make(chan bool),
-		ReadCh:        make(chan common.Message, 10),
-		SendCh:        make(chan common.Message, 10),
-		Closed:        false,
 	}
-	client.InitConfig()
-	return client
+	if err := client.InitConfig(configPath); err != nil {
+		return nil, err
+	}
+	return client, nil
 }
@@ -0,0 +1,283 @@
+package client
+
+import (
+	"bean/common"
+	"bean/handler"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const DefaultConfigPath = "./config/client.json"
+
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return "invalid client config: " + strings.Join(e.Problems, "; ")
+}
+
+func readClientConfig(path string) (*BeanClientConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, errors.New("client config " + path + " read error: " + err.Error())
+	}
+	clientConfig := &BeanClientConfig{
+		ResumeTimeout: 60,
+	}
+	err = json.Unmarshal(content, clientConfig)
+	if nil != err {
+		return nil, errors.New("client config " + path + " format error: " + err.Error())
+	}
+	problems := clientConfig.ApplyEnv()
+	problems = append(problems, clientConfig.Validate()...)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return clientConfig, nil
+}
+
+func (c *BeanClient) InitConfig(path string) error {
+	clientConfig, err := readClientConfig(path)
+	if err != nil {
+		return err
+	}
+	if clientConfig.ClientId == "" {
+		idFile := clientConfig.ClientIdFile
+		if idFile == "" {
+			idFile = filepath.Join(filepath.Dir(path), ".client_id")
+		}
+		var secret string
+		clientConfig.ClientId, secret, err = loadClientId(idFile)
+		if err != nil {
+			return errors.New("client id file " + idFile + " error: " + err.Error())
+		}
+		if clientConfig.ClientSecret == "" {
+			clientConfig.ClientSecret = secret
+		}
+	}
+	if clientConfig.ClientSecret == "" {
+		clientConfig.ClientSecret = handler.RandStringRunes(24)
+	}
+	if clientConfig.TLSEnable {
+		c.TLSConfig, err = newClientTLSConfig(clientConfig)
+		if err != nil {
+			return &ConfigError{Problems: []string{"tls: " + err.Error()}}
+		}
+	}
+	c.Config = clientConfig
+	c.ConfigPath = path
+	return nil
+}
+
+func loadClientId(path string) (string, string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	lines := strings.Fields(string(content))
+	if len(lines) >= 2 {
+		return lines[0], lines[1], nil
+	}
+	id := handler.RandStringRunes(16)
+	if len(lines) == 1 {
+		id = lines[0]
+	}
+	secret := handler.RandStringRunes(24)
+	err = ioutil.WriteFile(path, []byte(id+"\n"+secret+"\n"), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	return id, secret, nil
+}
+
+func serviceEnvPrefix(name string) string {
+	b := []rune(strings.ToUpper(name))
+	for i, r := range b {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			b[i] = '_'
+		}
+	}
+	return "BEAN_SERVICE_" + string(b) + "_"
+}
+
+func (c *BeanClientConfig) ApplyEnv() []string {
+	problems := make([]string, 0)
+	if v, ok := os.LookupEnv("BEAN_SERVER_ADDR"); ok {
+		c.ServerAddr = v
+	}
+	if v, ok := os.LookupEnv("BEAN_CLIENT_ID"); ok {
+		c.ClientId = v
+	}
+	if v, ok := os.LookupEnv("BEAN_CLIENT_SECRET"); ok {
+		c.ClientSecret = v
+	}
+	if v, ok := os.LookupEnv("BEAN_USER"); ok {
+		c.User = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TOKEN"); ok {
+		c.Token = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TLS_ENABLE"); ok {
+		enable, err := strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, "BEAN_TLS_ENABLE must be true or false: "+v)
+		} else {
+			c.TLSEnable = enable
+		}
+	}
+	if v, ok := os.LookupEnv("BEAN_TLS_CA_FILE"); ok {
+		c.TLSCAFile = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TLS_SERVER_NAME"); ok {
+		c.TLSServerName = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TLS_PIN_SHA256"); ok {
+		c.TLSPinSHA256 = strings.Split(v, ",")
+	}
+	if v, ok := os.LookupEnv("BEAN_PSK"); ok {
+		c.PSK = v
+	}
+	if v, ok := os.LookupEnv("BEAN_PSK_REKEY_BYTES"); ok {
+		rekey, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			problems = append(problems, "BEAN_PSK_REKEY_BYTES must be a number of bytes: "+v)
+		} else {
+			c.PSKRekeyBytes = rekey
+		}
+	}
+	for i := range c.ServiceList {
+		item := &c.ServiceList[i]
+		prefix := serviceEnvPrefix(item.Name)
+		if v, ok := os.LookupEnv(prefix + "LOCAL_ADDR"); ok {
+			item.LocalAddr = v
+		}
+		if v, ok := os.LookupEnv(prefix + "REMOTE_PORT"); ok {
+			port, err := common.ParsePortRange(v)
+			if err != nil {
+				problems = append(problems, prefix+"REMOTE_PORT is not a port or port range: "+v)
+			} else {
+				item.RemotePort = port
+			}
+		}
+		if v, ok := os.LookupEnv(prefix + "PROTOCOL"); ok {
+			item.Protocol = v
+		}
+		if v, ok := os.LookupEnv(prefix + "DOMAINS"); ok {
+			item.Domains = strings.Split(v, ",")
+		}
+		if v, ok := os.LookupEnv(prefix + "COMPRESSION"); ok {
+			item.Compression = v
+		}
+		if v, ok := os.LookupEnv(prefix + "PROXY_PROTOCOL"); ok {
+			item.ProxyProtocol = v
+		}
+		if v, ok := os.LookupEnv(prefix + "ALLOW_IPS"); ok {
+			item.AllowIPs = strings.Split(v, ",")
+		}
+		if v, ok := os.LookupEnv(prefix + "DENY_IPS"); ok {
+			item.DenyIPs = strings.Split(v, ",")
+		}
+		for _, env := range []string{"UPLOAD_LIMIT", "DOWNLOAD_LIMIT"} {
+			v, ok := os.LookupEnv(prefix + env)
+			if !ok {
+				continue
+			}
+			rate, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				problems = append(problems, prefix+env+" must be a number of bytes per second: "+v)
+			} else {
+				if item.RateLimit == nil {
+					item.RateLimit = &common.RateLimit{}
+				}
+				if env == "UPLOAD_LIMIT" {
+					item.RateLimit.Upload = rate
+				} else {
+					item.RateLimit.Download = rate
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func (c *BeanClientConfig) Validate() []string {
+	problems := make([]string, 0)
+	if c.ServerAddr == "" {
+		problems = append(problems, "server_addr is empty")
+	} else if _, _, err := net.SplitHostPort(c.ServerAddr); err != nil {
+		problems = append(problems, "server_addr "+c.ServerAddr+" is not host:port")
+	}
+	if len(c.ServiceList) == 0 {
+		problems = append(problems, "service_list is empty")
+	}
+	if c.PSK != "" && len(c.PSK) < 16 {
+		problems = append(problems, "psk must be at least 16 characters")
+	}
+	if c.PSKRekeyBytes < 0 {
+		problems = append(problems, "psk_rekey_bytes must not be negative")
+	}
+	names := make(map[string]bool)
+	ports := make(map[string]string)
+	for i, item := range c.ServiceList {
+		label := fmt.Sprintf("service_list[%d]", i)
+		if item.Name == "" {
+			problems = append(problems, label+" has no name")
+		} else {
+			label = "service " + item.Name
+			if names[item.Name] {
+				problems = append(problems, "duplicate service name "+item.Name)
+			}
+			names[item.Name] = true
+		}
+		if !common.ValidProtocol(item.Protocol) {
+			problems = append(problems, label+" protocol "+item.Protocol+" is not tcp, udp, http or https")
+		}
+		if common.IsVhostProtocol(item.Protocol) && len(item.Domains) == 0 {
+			problems = append(problems, label+" protocol "+item.Protocol+" needs domains")
+		}
+		if !common.IsVhostProtocol(item.Protocol) && len(item.Domains) > 0 {
+			problems = append(problems, label+" domains are only used by http and https services")
+		}
+		portKey := common.NormalizeProtocol(item.Protocol) + "/" + item.RemotePort.String()
+		if common.IsVhostProtocol(item.Protocol) {
+			portKey = ""
+		}
+		if other, ok := ports[portKey]; ok && portKey != "" && item.RemotePort.IsSingle() {
+			problems = append(problems, label+" remote_port "+item.RemotePort.String()+" already used by "+other)
+		} else {
+			ports[portKey] = item.Name
+		}
+		_, port, err := net.SplitHostPort(item.LocalAddr)
+		if err != nil {
+			problems = append(problems, label+" local_addr "+item.LocalAddr+" is not host:port")
+		} else if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			problems = append(problems, label+" local_addr "+item.LocalAddr+" has invalid port")
+		}
+		if !common.ValidProxyProtocol(item.ProxyProtocol) {
+			problems = append(problems, label+" proxy_protocol "+item.ProxyProtocol+" is not v1 or v2")
+		} else if item.ProxyProtocol != "" && common.NormalizeProtocol(item.Protocol) == common.ProtocolUDP {
+			problems = append(problems, label+" proxy_protocol is not supported for udp services")
+		}
+		if _, err := common.ParseIPFilter(item.AllowIPs, item.DenyIPs); err != nil {
+			problems = append(problems, label+" allow_ips/deny_ips: "+err.Error())
+		}
+		if err := item.RateLimit.Validate(); err != nil {
+			problems = append(problems, label+" rate_limit: "+err.Error())
+		}
+		if err := item.ConnLimit.Validate(); err != nil {
+			problems = append(problems, label+" conn_limit: "+err.Error())
+		}
+		if !common.ValidCompression(item.Compression) {
+			problems = append(problems, label+" compression "+item.Compression+" is not none or flate")
+		}
+	}
+	return problems
+}
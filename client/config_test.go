@@ -0,0 +1,25 @@
+package client
+
+import (
+	"testing"
+)
+
+func TestApplyEnvKeepsGoingAfterInvalidValue(t *testing.T) {
+	c := &BeanClientConfig{ServiceList: []BeanClientServiceItem{{Name: "echo", LocalAddr: "127.0.0.1:1"}}}
+	t.Setenv("BEAN_SERVICE_ECHO_REMOTE_PORT", "not-a-port")
+	t.Setenv("BEAN_SERVICE_ECHO_LOCAL_ADDR", "127.0.0.1:2")
+	t.Setenv("BEAN_SERVICE_ECHO_PROTOCOL", "udp")
+	t.Setenv("BEAN_SERVICE_ECHO_UPLOAD_LIMIT", "fast")
+	t.Setenv("BEAN_SERVICE_ECHO_DOWNLOAD_LIMIT", "4096")
+	problems := c.ApplyEnv()
+	if len(problems) != 2 {
+		t.Errorf("problems = %q, want 2", problems)
+	}
+	item := c.ServiceList[0]
+	if item.LocalAddr != "127.0.0.1:2" || item.Protocol != "udp" {
+		t.Errorf("overrides after an invalid value were skipped: %+v", item)
+	}
+	if item.RateLimit == nil || item.RateLimit.Upload != 0 || item.RateLimit.Download != 4096 {
+		t.Errorf("rate limit = %+v", item.RateLimit)
+	}
+}
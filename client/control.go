@@ -3,67 +3,183 @@ package client
 import (
 	"bean/common"
 	"bean/handler"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
-	"strconv"
 	"sync"
 	"time"
 )
 
+const (
+	localDialTimeout = 10 * time.Second
+	kickedRetryDelay = 5 * time.Minute
+)
+
 type BeanClient struct {
 	Id            string
-	Conn          net.Conn
 	Config        *BeanClientConfig
+	TLSConfig     *tls.Config
 	CloseSign     chan bool
 	RestartSign   chan bool
 	ServiceConfig map[string]BeanClientServiceItem
-	ProxyMap      map[string]net.Conn
-	ReadCh        chan common.Message
-	SendCh        chan common.Message
-	Closed        bool
+	ServiceState  map[string]common.ServiceStatus
+	ProxyMap      map[string]*ProxyConn
+	StreamMap     map[uint32]*ProxyConn
+	Stats         map[string]*common.CompressionStats
+	Shapers       map[string]*common.Shaper
+	ConfigPath    string
+	Control       *ControlConn
+	Outbox        *common.Outbox
+	Session       string
+	Caps          []string
+	LostAt        time.Time
+	Retries       int
+	Backoff       time.Duration
 	Mutex         sync.Mutex
 }
 
-func (c *BeanClient) Clear() {
-	c.ReadCh = make(chan common.Message, 100)
-	c.SendCh = make(chan common.Message, 100)
-	c.Closed = false
+type ControlConn struct {
+	Conn    net.Conn
+	Outbox  *common.Outbox
+	ReadCh  chan common.Message
+	SendCh  chan common.Message
+	CloseCh chan struct{}
+	Closed  bool
+	client  *BeanClient
+	wg      sync.WaitGroup
+	Mutex   sync.Mutex
+}
+
+func newControlConn(client *BeanClient, conn net.Conn) *ControlConn {
+	return &ControlConn{
+		Conn:    conn,
+		ReadCh:  make(chan common.Message, 100),
+		SendCh:  make(chan common.Message, 100),
+		CloseCh: make(chan struct{}),
+		client:  client,
+	}
+}
+
+func (cc *ControlConn) Close() {
+	cc.Mutex.Lock()
+	if cc.Closed {
+		cc.Mutex.Unlock()
+		return
+	}
+	cc.Closed = true
+	close(cc.CloseCh)
+	cc.Mutex.Unlock()
+	cc.client.connLost(cc)
+	cc.Conn.Close()
+}
+
+func (cc *ControlConn) isClosed() bool {
+	cc.Mutex.Lock()
+	defer cc.Mutex.Unlock()
+	return cc.Closed
+}
+
+func (cc *ControlConn) Done() <-chan struct{} {
+	return cc.CloseCh
+}
+
+func (cc *ControlConn) Send(m common.Message) bool {
+	select {
+	case cc.SendCh <- m:
+		return true
+	case <-cc.CloseCh:
+		return false
+	}
+}
+
+func (cc *ControlConn) WorkConn() net.Conn {
+	return cc.Conn
+}
+
+func (cc *ControlConn) Sender() *common.Outbox {
+	return cc.Outbox
+}
+
+func (cc *ControlConn) ReaderCh() chan common.Message {
+	return cc.ReadCh
+}
+
+func (cc *ControlConn) SenderCh() chan common.Message {
+	return cc.SendCh
 }
 
-func (c *BeanClient) Close() {
+func (cc *ControlConn) start() {
+	cc.wg.Add(2)
+	go func() {
+		defer cc.wg.Done()
+		common.MessageWriter(cc)
+	}()
+	go func() {
+		defer cc.wg.Done()
+		common.MessageReader(cc)
+	}()
+}
+
+func (c *BeanClient) connLost(cc *ControlConn) {
 	c.Mutex.Lock()
-	if !c.Closed {
-		close(c.ReadCh)
-		close(c.SendCh)
-		c.Closed = true
+	if c.Control != cc {
+		c.Mutex.Unlock()
+		return
 	}
+	c.Control = nil
+	c.LostAt = time.Now()
+	resume := c.Config.ResumeTimeout > 0 && c.Session != ""
 	c.Mutex.Unlock()
-	if c.Conn != nil {
-		c.Conn.Close()
+	if !resume {
+		c.resetStreams()
+	} else if cc.Outbox != nil {
+		cc.Outbox.Detach(cc.Conn)
 	}
-	for _, v := range c.ProxyMap {
-		if v != nil {
-			v.Close()
-		}
+}
+
+func (c *BeanClient) resetStreams() {
+	c.Mutex.Lock()
+	for id, v := range c.ProxyMap {
+		v.Abort()
+		delete(c.ProxyMap, id)
+	}
+	c.StreamMap = make(map[uint32]*ProxyConn)
+	outbox := c.Outbox
+	c.Session = ""
+	c.Mutex.Unlock()
+	if outbox != nil {
+		outbox.Close()
 	}
 }
 
-func (c *BeanClient) WorkConn() net.Conn {
-	return c.Conn
+func (c *BeanClient) control() *ControlConn {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.Control
 }
 
-func (c *BeanClient) ReaderCh() chan common.Message {
-	return c.ReadCh
+func (c *BeanClient) outbox() *common.Outbox {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.Outbox
 }
 
-func (c *BeanClient) SenderCh() chan common.Message {
-	return c.SendCh
+func (c *BeanClient) Send(m common.Message) bool {
+	cc := c.control()
+	if cc != nil {
+		return cc.Send(m)
+	}
+	if outbox := c.outbox(); outbox != nil {
+		return outbox.Write(m) == nil
+	}
+	return false
 }
 
 func (c *BeanClient) Run() {
+	go c.WatchReload()
 	go c.RunClient(false)
 	for {
 		select {
@@ -71,31 +187,37 @@ func (c *BeanClient) Run() {
 			fmt.Println("system exit sign")
 			return
 		case <-c.RestartSign:
-			c.Clear()
-			time.Sleep(15 * time.Second)
+			c.Mutex.Lock()
+			delay := 15 * time.Second
+			if c.Retries == 0 && c.Session != "" {
+				delay = time.Second
+			}
+			if c.Backoff > 0 {
+				delay, c.Backoff = c.Backoff, 0
+			}
+			c.Retries++
+			c.Mutex.Unlock()
+			time.Sleep(delay)
+			c.Mutex.Lock()
+			expired := !c.LostAt.IsZero() && time.Since(c.LostAt) > time.Duration(c.Config.ResumeTimeout)*time.Second
+			c.Mutex.Unlock()
+			if expired {
+				c.resetStreams()
+			}
 			fmt.Println("client restart sign")
 			go c.RunClient(true)
 		}
 	}
 }
 
-func (c *BeanClient) InitConfig() {
-	content, err := ioutil.ReadFile("./config/client.json")
-	if nil != err {
-		fmt.Println("config.json read error ")
-		panic(err)
-	}
-	var clientConfig BeanClientConfig
-	err = json.Unmarshal(content, &clientConfig)
-	if nil != err {
-		fmt.Println("json config Unmarshal error ")
-		panic(err)
-	}
-	c.Config = &clientConfig
-}
-
 func (c *BeanClient) RunClient(restartFlag bool) {
-	conn, err := net.Dial("tcp", c.Config.ServerAddr)
+	var conn net.Conn
+	var err error
+	if c.TLSConfig != nil {
+		conn, err = tls.Dial("tcp", c.Config.ServerAddr, c.TLSConfig)
+	} else {
+		conn, err = net.Dial("tcp", c.Config.ServerAddr)
+	}
 	if nil != err {
 		fmt.Printf("err %v: \r\n", err)
 		if restartFlag {
@@ -105,104 +227,426 @@ func (c *BeanClient) RunClient(restartFlag bool) {
 		}
 		return
 	}
-	c.Conn = conn
+	if c.Config.PSK != "" {
+		secure, err := common.ClientPSKHandshake(conn, c.Config.PSK, c.Config.PSKRekeyBytes)
+		if err != nil {
+			fmt.Printf("err %v: \r\n", err)
+			conn.Close()
+			if err == common.ErrPSKMismatch {
+				c.CloseSign <- true
+			} else if restartFlag {
+				c.RestartSign <- true
+			} else {
+				c.CloseSign <- true
+			}
+			return
+		}
+		conn = secure
+	}
 	fmt.Println("链接到服务器成功....")
-	c.LoginToServer()
+	cc := newControlConn(c, conn)
+	err = c.LoginToServer(cc)
+	if nil != err {
+		conn.Close()
+		c.resetStreams()
+		loginErr, ok := err.(*LoginError)
+		if ok && (loginErr.Reason == common.ReasonAuthFailed || loginErr.Reason == common.ReasonIncompatible) {
+			c.CloseSign <- true
+		} else if ok && (loginErr.Reason == common.ReasonKicked || loginErr.Reason == common.ReasonInUse) {
+			backoff := time.Duration(loginErr.RetryAfter) * time.Second
+			if backoff <= 0 {
+				backoff = kickedRetryDelay
+			}
+			fmt.Printf("login refused: %s, retry in %v \r\n", loginErr.Message, backoff)
+			c.Mutex.Lock()
+			c.Backoff = backoff
+			c.Mutex.Unlock()
+			c.RestartSign <- true
+		} else {
+			c.RestartSign <- true
+		}
+		return
+	}
 	fmt.Println("登陆服务器成功....")
-	go common.MessageWriter(c)
-	go common.MessageReader(c)
-	go c.TransportMessage()
+	c.Mutex.Lock()
+	c.Retries = 0
+	c.LostAt = time.Time{}
+	c.Control = cc
+	c.Mutex.Unlock()
+	cc.start()
+	go c.TransportMessage(cc)
 }
 
-func (c *BeanClient) TransportMessage() {
-	ticker := time.NewTicker(10 * time.Second)
+func (c *BeanClient) TransportMessage(cc *ControlConn) {
+	ticker := time.NewTicker(common.HeartbeatInterval)
 	defer func() {
 		if err := recover(); err != nil {
 			fmt.Printf("panic error TransportMessage err %v: \r\n", err)
 			ticker.Stop()
+			cc.Close()
+			cc.wg.Wait()
 			c.RestartSign <- true
 			return
 		}
 	}()
 	for {
 		select {
+		case <-cc.CloseCh:
+			fmt.Println("connection closed, restart")
+			ticker.Stop()
+			cc.wg.Wait()
+			c.RestartSign <- true
+			return
 		case t := <-ticker.C:
 			htReq := common.HearBeatRequest{
 				SendTime: t,
 			}
-			c.SendCh <- &htReq
-		case message := <-c.ReadCh:
+			cc.Send(&htReq)
+			cc.Send(cc.Outbox.AckMessage())
+		case message := <-cc.ReadCh:
+			accept, ack := cc.Outbox.Receive(message)
+			if ack != nil {
+				cc.Send(ack)
+			}
+			if !accept {
+				continue
+			}
 			switch v := message.(type) {
+			case *common.AckRequest:
+				cc.Outbox.Ack(v.Seq)
 			case *common.ConnectRequest:
-				createPortSvr(v, c)
+				go createPortSvr(v, c)
 			case *common.BinDataRequestWrapper:
 				ReadSvrMessage(v, c)
 			case *common.HearBeatResponse:
 				fmt.Println("heart beat resp id = " + v.Cid)
+			case *common.WindowUpdate:
+				proxy, ok := c.getProxy(v.Id, 0)
+				if ok {
+					proxy.Window.Grant(v.Credit)
+				}
 			case *common.CloseRequest:
-				conn, ok := c.ProxyMap[v.Id]
+				proxy, ok := c.removeProxy(v.Id)
 				if ok {
-					conn.Close()
-					delete(c.ProxyMap, v.Id)
+					proxy.Close()
 				}
+			case *common.RateLimitResponse:
+				c.applyRateLimit(v)
 			default:
 			}
 		}
 	}
 }
-func (c *BeanClient) LoginToServer() {
+func (c *BeanClient) Hello(conn net.Conn) error {
+	helloReq := common.NewHelloRequest(c.Config.PSK != "")
+	err := common.SendMessage(conn, helloReq)
+	if nil != err {
+		fmt.Printf("wr error %+v \r\n", err)
+		return err
+	}
+	rawMessage, err := common.ReadMessageWait(conn)
+	if nil != err {
+		fmt.Printf("rd error %+v \r\n", err)
+		return err
+	}
+	message, err := common.ParseMessage(rawMessage)
+	if nil != err {
+		return err
+	}
+	switch v := message.(type) {
+	case *common.HelloResponse:
+		if !v.Success {
+			fmt.Printf("hello refused %v: \r\n", v.Message)
+			return &LoginError{Reason: v.Reason, Message: v.Message}
+		}
+		if common.HasCapability(v.Capabilities, common.CapEncryption) != (c.Config.PSK != "") {
+			return &LoginError{Reason: common.ReasonIncompatible, Message: "server and client disagree on pre-shared key encryption"}
+		}
+		fmt.Printf("server protocol %d build %s capabilities %v \r\n", v.Version, v.Build, v.Capabilities)
+		c.Mutex.Lock()
+		c.Caps = v.Capabilities
+		c.Mutex.Unlock()
+		return nil
+	case *common.ServiceResponse:
+		return &LoginError{Reason: common.ReasonIncompatible, Message: "server does not support protocol negotiation"}
+	default:
+		return errors.New("unexpected hello response type")
+	}
+}
+
+func (c *BeanClient) LoginToServer(cc *ControlConn) error {
+	if err := c.Hello(cc.Conn); err != nil {
+		return err
+	}
 	srReq := &common.ServiceRequest{
-		Id:          handler.RandStringRunes(12),
+		Id:          c.Config.ClientId,
+		User:        c.Config.User,
+		Token:       c.Config.Token,
+		Secret:      c.Config.ClientSecret,
 		ServiceList: make([]common.ServiceBody, 0),
 		ReqTime:     time.Now(),
 	}
+	c.Mutex.Lock()
+	if c.Session != "" && c.Outbox != nil && common.HasCapability(c.Caps, common.CapResume) {
+		srReq.Resume = &common.ResumeRequest{
+			Session: c.Session,
+			RecvSeq: c.Outbox.RecvSeq(),
+		}
+	}
 	for _, item := range c.Config.ServiceList {
 		svrBody := common.ServiceBody{
-			Name:       item.Name,
-			RemotePort: item.RemotePort,
+			Name:        item.Name,
+			Protocol:    common.NormalizeProtocol(item.Protocol),
+			RemotePort:  item.RemotePort,
+			Domains:     item.Domains,
+			AllowIPs:    item.AllowIPs,
+			DenyIPs:     item.DenyIPs,
+			Compression: common.NormalizeCompression(item.Compression),
+			RateLimit:   item.RateLimit,
+			ConnLimit:   item.ConnLimit,
 		}
 		c.ServiceConfig[item.Name] = item
 		srReq.ServiceList = append(srReq.ServiceList, svrBody)
 	}
-	err := common.WriteMessage(c.Conn, int8(1), srReq)
+	c.Mutex.Unlock()
+	err := common.SendMessage(cc.Conn, srReq)
 	if nil != err {
 		fmt.Printf("wr error %+v \r\n", err)
-		c.RestartSign <- true
-		return
+		return err
 	}
-	rawMessage, err := common.ReadMessageWait(c.Conn)
+	rawMessage, err := common.ReadMessageWait(cc.Conn)
 	if nil != err {
 		fmt.Printf("rd error %+v \r\n", err)
-		c.RestartSign <- true
-		return
+		return err
 	}
-	if rawMessage.Type != 2 {
-		fmt.Printf("raw error %+v \r\n", err)
-		c.RestartSign <- true
-		return
+	if rawMessage.Type != common.TypeServiceResponse {
+		fmt.Printf("raw error type %d \r\n", rawMessage.Type)
+		return errors.New("unexpected login response type")
 	}
 	var srResp common.ServiceResponse
 	err = json.Unmarshal(rawMessage.Body, &srResp)
 	if nil != err {
 		fmt.Printf("json.Unmarshal error %+v \r\n", err)
-		c.RestartSign <- true
-		return
+		return err
 	}
-	fmt.Printf("service open success %v: \r\n", srResp)
+	c.updateServiceStates(srResp.Services)
+	if !srResp.Success {
+		fmt.Printf("service open failed %s: \r\n", srResp.Message)
+		return &LoginError{Reason: srResp.Reason, Message: srResp.Message, RetryAfter: srResp.RetryAfter}
+	}
+	fmt.Printf("client %s service open success %s: \r\n", srResp.Id, srResp.Message)
+	c.Mutex.Lock()
 	c.Id = srResp.Id
+	outbox := c.Outbox
+	c.Mutex.Unlock()
+	if srResp.Resumed && outbox != nil {
+		err = outbox.Resume(cc.Conn, srResp.RecvSeq, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Println("session resumed")
+	} else {
+		c.resetStreams()
+		outbox = common.NewOutbox(cc.Conn, common.DefaultOutboxLimit)
+	}
+	cc.Outbox = outbox
+	c.Mutex.Lock()
+	c.Outbox = outbox
+	c.Session = srResp.Session
+	c.Mutex.Unlock()
+	return nil
+}
+
+func (c *BeanClient) updateServiceStates(services []common.ServiceStatus) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.ServiceState = make(map[string]common.ServiceStatus)
+	for _, status := range services {
+		c.ServiceState[status.Name] = status
+		if _, ok := c.Stats[status.Name]; !ok {
+			c.Stats[status.Name] = &common.CompressionStats{}
+		}
+		if shaper, ok := c.Shapers[status.Name]; ok {
+			shaper.SetLimit(status.RateLimit)
+		} else {
+			c.Shapers[status.Name] = common.NewShaper(status.RateLimit)
+		}
+		if status.Success && common.NormalizeProtocol(status.Protocol) != common.NormalizeProtocol(c.ServiceConfig[status.Name].Protocol) {
+			fmt.Printf("service %s protocol mismatch, server opened %s \r\n", status.Name, common.NormalizeProtocol(status.Protocol))
+		}
+		if status.Success && len(status.Domains) > 0 {
+			fmt.Printf("service %s open success, remote %v via %s -> local %s \r\n", status.Name, status.Domains, status.BindAddr, c.ServiceConfig[status.Name].LocalAddr)
+		} else if status.Success {
+			fmt.Printf("service %s open success, remote %s -> local %s \r\n", status.Name, status.BindAddr, c.ServiceConfig[status.Name].LocalAddr)
+		} else {
+			fmt.Printf("service %s open failed, remote port %d, reason %s: %s \r\n", status.Name, status.RemotePort, status.Reason, status.Message)
+		}
+		if status.Success && status.RateLimit != nil {
+			fmt.Printf("service %s rate limit %+v \r\n", status.Name, *status.RateLimit)
+		}
+		if status.Success && status.ConnLimit != nil {
+			fmt.Printf("service %s connection limit %+v \r\n", status.Name, *status.ConnLimit)
+		}
+	}
+}
+
+func (c *BeanClient) CompressionStats() map[string]*common.CompressionStats {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	stats := make(map[string]*common.CompressionStats, len(c.Stats))
+	for name, v := range c.Stats {
+		stats[name] = v
+	}
+	return stats
+}
+
+func (c *BeanClient) serviceStream(name string) (bool, *common.CompressionStats) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.ServiceState[name].Compression == common.CompressionFlate, c.Stats[name]
+}
+
+func (c *BeanClient) ServiceStates() []common.ServiceStatus {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	states := make([]common.ServiceStatus, 0, len(c.Config.ServiceList))
+	for _, item := range c.Config.ServiceList {
+		status, ok := c.ServiceState[item.Name]
+		if !ok {
+			status = common.ServiceStatus{Name: item.Name, RemotePort: item.RemotePort.Start, Message: "not registered"}
+		}
+		states = append(states, status)
+	}
+	return states
+}
+
+type LoginError struct {
+	Reason     string
+	Message    string
+	RetryAfter int
+}
+
+func (e *LoginError) Error() string {
+	return "login rejected: " + e.Message
+}
+
+type ProxyConn struct {
+	Id     string
+	Sid    uint32
+	Name   string
+	Conn   net.Conn
+	Window *common.SendWindow
+	Writer *common.StreamWriter
+	Shape  *common.ConnShaper
+}
+
+func NewProxyConn(request *common.ConnectRequest, conn net.Conn, clientApplication *BeanClient) *ProxyConn {
+	outbox := clientApplication.outbox()
+	proxy := &ProxyConn{
+		Id:     request.Id,
+		Sid:    request.Sid,
+		Name:   request.Name,
+		Conn:   conn,
+		Window: common.NewSendWindow(common.DefaultStreamWindow),
+		Shape:  clientApplication.serviceShaper(request.Name).Open(),
+	}
+	proxy.Writer = common.NewStreamWriter(conn, common.DefaultStreamWindow, func(n int) {
+		outbox.Write(&common.WindowUpdate{Id: proxy.Id, Name: proxy.Name, Credit: n})
+	}, func(err error) {
+		if !streamClosed(err) {
+			fmt.Printf("connLocal Write  err %v: \r\n", err)
+		}
+		proxy.Window.Close()
+		clientApplication.removeProxy(proxy.Id)
+		outbox.Write(&common.CloseRequest{Id: proxy.Id, Name: proxy.Name})
+	})
+	proxy.Writer.Limit(proxy.Shape.DownloadBuckets())
+	return proxy
+}
+
+func (p *ProxyConn) Abort() {
+	p.Shape.Release()
+	p.Window.Close()
+	p.Writer.Abort()
+}
 
+func (p *ProxyConn) Close() {
+	p.Shape.Release()
+	p.Window.Close()
+	p.Writer.Close()
+}
+
+func (c *BeanClient) addProxy(proxy *ProxyConn) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	c.ProxyMap[proxy.Id] = proxy
+	if proxy.Sid != 0 {
+		c.StreamMap[proxy.Sid] = proxy
+	}
+}
+
+func (c *BeanClient) getProxy(id string, sid uint32) (*ProxyConn, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if sid != 0 {
+		proxy, ok := c.StreamMap[sid]
+		return proxy, ok
+	}
+	proxy, ok := c.ProxyMap[id]
+	return proxy, ok
+}
+
+func (c *BeanClient) removeProxy(id string) (*ProxyConn, bool) {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	proxy, ok := c.ProxyMap[id]
+	if ok {
+		delete(c.ProxyMap, id)
+		if c.StreamMap[proxy.Sid] == proxy {
+			delete(c.StreamMap, proxy.Sid)
+		}
+	}
+	return proxy, ok
+}
+
+func writeProxyHeader(conn net.Conn, version string, request *common.ConnectRequest) error {
+	header, err := common.BuildProxyHeader(version, request.Ip, request.Dst)
+	if err == nil {
+		conn.SetWriteDeadline(time.Now().Add(localDialTimeout))
+		_, err = conn.Write(header)
+		conn.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+	}
+	return err
+}
+
+func (c *BeanClient) serviceItem(name string) BeanClientServiceItem {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return c.ServiceConfig[name]
+}
+
+func (c *BeanClient) hasCapability(capability string) bool {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return common.HasCapability(c.Caps, capability)
 }
 
 func createPortSvr(request *common.ConnectRequest, clientApplication *BeanClient) {
-	serviceConfig := clientApplication.ServiceConfig[request.Name]
-	connLocal, err := net.Dial("tcp", serviceConfig.LocalAddr)
+	serviceConfig := clientApplication.serviceItem(request.Name)
+	connLocal, err := net.DialTimeout(common.DialNetwork(serviceConfig.Protocol), serviceConfig.LocalAddr, localDialTimeout)
+	if err == nil && serviceConfig.ProxyProtocol != "" {
+		err = writeProxyHeader(connLocal, serviceConfig.ProxyProtocol, request)
+	}
 	if err != nil {
 		fmt.Printf("err %v: \r\n", err)
 		closeReq := &common.CloseRequest{
 			Id:   request.Id,
 			Name: request.Name,
 		}
-		clientApplication.SendCh <- closeReq
+		clientApplication.Send(closeReq)
 		return
 	}
 	crResp := &common.ConnectResponse{
@@ -210,62 +654,70 @@ func createPortSvr(request *common.ConnectRequest, clientApplication *BeanClient
 		Id:      request.Id,
 		Name:    request.Name,
 	}
-	clientApplication.SendCh <- crResp
-	clientApplication.ProxyMap[request.Id] = connLocal
-	go ReadLocalSvrMessage(clientApplication, connLocal, request)
+	if !clientApplication.hasCapability(common.CapBinaryFrames) {
+		request.Sid = 0
+	}
+	crResp.Sid = request.Sid
+	proxy := NewProxyConn(request, connLocal, clientApplication)
+	clientApplication.addProxy(proxy)
+	clientApplication.Send(crResp)
+	go ReadLocalSvrMessage(clientApplication, proxy, serviceConfig)
+}
+
+func streamClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, common.ErrStreamClosed)
 }
 
-func ReadLocalSvrMessage(clientApplication *BeanClient, connLocal net.Conn, request *common.ConnectRequest) {
+func ReadLocalSvrMessage(clientApplication *BeanClient, proxy *ProxyConn, serviceConfig BeanClientServiceItem) {
+	outbox := clientApplication.outbox()
+	compress, stats := clientApplication.serviceStream(proxy.Name)
 	cwr := &common.JoinWriter{
-		Sender: clientApplication.Conn,
-		Id:     request.Id,
-		Name:   request.Name,
+		Sender:   outbox,
+		Window:   proxy.Window,
+		Id:       proxy.Id,
+		Sid:      proxy.Sid,
+		Name:     proxy.Name,
+		Compress: compress,
+		Datagram: common.NormalizeProtocol(serviceConfig.Protocol) == common.ProtocolUDP,
+		Stats:    stats,
+		Limiters: proxy.Shape.UploadBuckets(),
 	}
 	buf := make([]byte, 16*1024)
-	written, err := io.CopyBuffer(cwr, connLocal, buf)
-	fmt.Println("cwr = " + strconv.Itoa(int(written)))
-	if err != nil {
+	if cwr.Datagram {
+		buf = make([]byte, 64*1024)
+	}
+	written, err := io.CopyBuffer(cwr, proxy.Conn, buf)
+	handler.Debugf("service %s stream %s closed, %d bytes sent", proxy.Name, proxy.Id, written)
+	if compress && stats != nil {
+		handler.Debugf("service %s compression %s", proxy.Name, stats.String())
+	}
+	if err != nil && !streamClosed(err) {
 		fmt.Printf("err %v: \r\n", err)
-		connLocal.Close()
-		dtReq := &common.CloseRequest{
-			Id:   request.Id,
-			Name: request.Name,
-		}
-		clientApplication.Mutex.Lock()
-		delete(clientApplication.ProxyMap, request.Id)
-		clientApplication.Mutex.Unlock()
-		messageType := common.ParseMessageType(dtReq)
-		if err = common.WriteMessageByType(clientApplication.Conn, int8(messageType), dtReq); err != nil {
-			fmt.Printf("panic error ReadLocalSvrMessage err %v: \r\n", err)
-			clientApplication.Close()
-			clientApplication.RestartSign <- true
-		}
+	}
+	proxy.Close()
+	dtReq := &common.CloseRequest{
+		Id:   proxy.Id,
+		Name: proxy.Name,
+	}
+	clientApplication.removeProxy(proxy.Id)
+	if err = outbox.Write(dtReq); err != nil {
+		fmt.Printf("ReadLocalSvrMessage close err %v: \r\n", err)
 	}
 }
 
 func ReadSvrMessage(dtReq *common.BinDataRequestWrapper, clientApplication *BeanClient) {
-	connLocal, ok := clientApplication.ProxyMap[dtReq.Id]
-	var err error
-	defer func() {
-		if nil != err {
-			connLocal.Close()
-			closeReq := &common.CloseRequest{
-				Id:   dtReq.Id,
-				Name: dtReq.Name,
-			}
-			clientApplication.SendCh <- closeReq
-			clientApplication.Mutex.Lock()
-			delete(clientApplication.ProxyMap, dtReq.Id)
-			clientApplication.Mutex.Unlock()
-		}
-	}()
+	proxy, ok := clientApplication.getProxy(dtReq.Id, dtReq.Sid)
 	if !ok {
 		fmt.Printf("connLocal == nil err \r\n")
 		return
 	}
-	_, err = connLocal.Write(dtReq.Content)
-	if err != nil {
+	if _, stats := clientApplication.serviceStream(proxy.Name); stats != nil {
+		stats.Add(len(dtReq.Content), dtReq.Wire)
+	}
+	if err := proxy.Writer.Push(dtReq.Content); err != nil {
 		fmt.Printf("connLocal Write  err %v: \r\n", err)
-		return
+		proxy.Abort()
+		clientApplication.removeProxy(proxy.Id)
+		clientApplication.Send(&common.CloseRequest{Id: proxy.Id, Name: proxy.Name})
 	}
 }
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"bean/common"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func writeClientConfig(t *testing.T, path string, localAddr string, upload int) {
+	content := fmt.Sprintf(`{"server_addr": "127.0.0.1:1", "client_id": "test", "service_list": [
+		{"name": "echo", "remote_port": 3306, "local_addr": %q, "rate_limit": {"upload": %d}}]}`, localAddr, upload)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func localSink(t *testing.T) net.Listener {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listen
+}
+
+func (c *BeanClient) proxyCount() int {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	return len(c.ProxyMap)
+}
+
+func TestReloadRateLimitsWhileStreamsOpen(t *testing.T) {
+	local := localSink(t)
+	defer local.Close()
+	path := filepath.Join(t.TempDir(), "client.json")
+	writeClientConfig(t, path, local.Addr().String(), 1024)
+	c, err := NewClientApplication(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Outbox = common.NewOutbox(nil, common.DefaultOutboxLimit)
+	c.Caps = common.SupportedCapabilities
+	c.ServiceConfig["echo"] = c.Config.ServiceList[0]
+	const streams = 50
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < streams; i++ {
+			writeClientConfig(t, path, local.Addr().String(), 2048+i)
+			if err := c.ReloadRateLimits(); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < streams; i++ {
+		createPortSvr(&common.ConnectRequest{Id: strconv.Itoa(i), Sid: uint32(i + 1), Name: "echo"}, c)
+	}
+	<-done
+	deadline := time.Now().Add(5 * time.Second)
+	for c.proxyCount() < streams && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := c.proxyCount(); n != streams {
+		t.Errorf("%d streams opened, want %d", n, streams)
+	}
+	if limit := c.serviceItem("echo").RateLimit; limit == nil || limit.Upload != 2048+streams-1 {
+		t.Errorf("reloaded rate limit = %+v", limit)
+	}
+	c.resetStreams()
+}
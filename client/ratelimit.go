@@ -0,0 +1,79 @@
+package client
+
+import (
+	"bean/common"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+)
+
+func (c *BeanClient) serviceShaper(name string) *common.Shaper {
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	shaper, ok := c.Shapers[name]
+	if !ok {
+		shaper = common.NewShaper(c.ServiceState[name].RateLimit)
+		c.Shapers[name] = shaper
+	}
+	return shaper
+}
+
+func (c *BeanClient) applyRateLimit(resp *common.RateLimitResponse) {
+	if !resp.Success {
+		fmt.Printf("service %s rate limit update refused: %s \r\n", resp.Name, resp.Message)
+		return
+	}
+	c.serviceShaper(resp.Name).SetLimit(resp.RateLimit)
+	c.Mutex.Lock()
+	if status, ok := c.ServiceState[resp.Name]; ok {
+		status.RateLimit = resp.RateLimit
+		c.ServiceState[resp.Name] = status
+	}
+	c.Mutex.Unlock()
+	fmt.Printf("service %s rate limit now %+v \r\n", resp.Name, *c.serviceShaper(resp.Name).Limit())
+}
+
+func (c *BeanClient) ReloadRateLimits() error {
+	fresh, err := readClientConfig(c.ConfigPath)
+	if err != nil {
+		return err
+	}
+	limits := make(map[string]*common.RateLimit, len(fresh.ServiceList))
+	for _, item := range fresh.ServiceList {
+		limits[item.Name] = item.RateLimit
+	}
+	changed := make([]*common.RateLimitRequest, 0)
+	c.Mutex.Lock()
+	for i := range c.Config.ServiceList {
+		item := &c.Config.ServiceList[i]
+		limit, ok := limits[item.Name]
+		if !ok || reflect.DeepEqual(limit, item.RateLimit) {
+			continue
+		}
+		item.RateLimit = limit
+		c.ServiceConfig[item.Name] = *item
+		changed = append(changed, &common.RateLimitRequest{Name: item.Name, RateLimit: limit})
+	}
+	live := c.Control != nil && !c.Control.isClosed() && common.HasCapability(c.Caps, common.CapRateLimit)
+	c.Mutex.Unlock()
+	for _, req := range changed {
+		if !live {
+			fmt.Printf("service %s rate limit changed, applied on next login \r\n", req.Name)
+			continue
+		}
+		c.Send(req)
+	}
+	return nil
+}
+
+func (c *BeanClient) WatchReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := c.ReloadRateLimits(); err != nil {
+			fmt.Printf("reload config %s err %v \r\n", c.ConfigPath, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package client
+
+import (
+	"bean/common"
+	"crypto/tls"
+	"net"
+)
+
+func newClientTLSConfig(config *BeanClientConfig) (*tls.Config, error) {
+	serverName := config.TLSServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(config.ServerAddr)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.TLSCAFile != "" {
+		pool, err := common.LoadCertPool(config.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(config.TLSPinSHA256) > 0 {
+		// chain verification moves into the pin verifier so self-signed pinned certs are accepted
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = common.PinnedCertVerifier(config.TLSPinSHA256, tlsConfig.RootCAs, serverName)
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	cases := []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		want        bool
+	}{
+		{"empty filter", nil, nil, "192.0.2.1", true},
+		{"allow match", []string{"10.0.0.0/8"}, nil, "10.1.2.3", true},
+		{"allow miss", []string{"10.0.0.0/8"}, nil, "192.0.2.1", false},
+		{"deny match", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"deny miss", nil, []string{"192.0.2.0/24"}, "198.51.100.1", true},
+		{"deny wins over allow", []string{"10.0.0.0/8"}, []string{"10.0.0.5"}, "10.0.0.5", false},
+		{"allow beside deny", []string{"10.0.0.0/8"}, []string{"10.0.0.5"}, "10.0.0.6", true},
+		{"mapped ip allowed by ipv4 cidr", []string{"10.0.0.0/8"}, nil, "::ffff:10.1.2.3", true},
+		{"mapped ip denied by ipv4 host", nil, []string{"192.0.2.1"}, "::ffff:192.0.2.1", false},
+		{"ipv4 ip denied by mapped cidr", nil, []string{"::ffff:192.0.2.0/120"}, "192.0.2.9", false},
+		{"ipv4 ip allowed by mapped host", []string{"::ffff:10.0.0.1"}, nil, "10.0.0.1", true},
+		{"ipv6 allow", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"ipv6 does not match ipv4 rule", []string{"10.0.0.0/8"}, nil, "2001:db8::1", false},
+		{"ipv6 deny", []string{"::/0"}, []string{"2001:db8::/32"}, "2001:db8::1", false},
+	}
+	for _, c := range cases {
+		f, err := ParseIPFilter(c.allow, c.deny)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := f.Allowed(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("%s: Allowed(%s) = %v, want %v", c.name, c.ip, got, c.want)
+		}
+	}
+}
+
+func TestIPFilterUnknownAddr(t *testing.T) {
+	var nilFilter *IPFilter
+	if !nilFilter.Allowed(nil) || !nilFilter.Empty() {
+		t.Error("nil filter must allow everything")
+	}
+	f, _ := ParseIPFilter(nil, []string{"192.0.2.0/24"})
+	if f.Allowed(nil) {
+		t.Error("filter with rules allowed an unknown address")
+	}
+}
+
+func TestParseIPFilterInvalid(t *testing.T) {
+	for _, item := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.256"} {
+		if _, err := ParseIPFilter([]string{item}, nil); err == nil {
+			t.Errorf("ParseIPFilter accepted %q", item)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+)
+
+const (
+	TypeServiceRequest  = 1
+	TypeServiceResponse = 2
+	TypeConnectRequest  = 3
+	TypeConnectResponse = 4
+	TypeBinData         = 5
+	TypeCloseRequest    = 6
+	TypeHearBeatRequest = 7
+	TypeHearBeatResp    = 8
+	TypeAckRequest      = 9
+	TypeWindowUpdate    = 10
+	TypeDataFrame       = 11
+	TypeHelloRequest    = 12
+	TypeHelloResponse   = 13
+	TypeRateLimitReq    = 14
+	TypeRateLimitResp   = 15
+)
+
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+type Codec struct {
+	Type   byte
+	Decode func(body []byte) (Message, error)
+	Encode func(conn net.Conn, m Message) error
+}
+
+var (
+	decoders = make(map[byte]*Codec)
+	encoders = make(map[reflect.Type]*Codec)
+)
+
+func RegisterCodec(sample Message, codec *Codec) {
+	if _, ok := decoders[codec.Type]; ok && codec.Decode != nil {
+		panic("duplicate message type " + strconv.Itoa(int(codec.Type)))
+	}
+	if codec.Decode != nil {
+		decoders[codec.Type] = codec
+	}
+	if sample != nil {
+		encoders[reflect.TypeOf(sample)] = codec
+	}
+}
+
+func RegisterMessage(typ byte, sample Message) {
+	elem := reflect.TypeOf(sample).Elem()
+	RegisterCodec(sample, &Codec{
+		Type: typ,
+		Decode: func(body []byte) (Message, error) {
+			m := reflect.New(elem).Interface()
+			err := json.Unmarshal(body, m)
+			return m, err
+		},
+		Encode: func(conn net.Conn, m Message) error {
+			return WriteMessage(conn, int8(typ), m)
+		},
+	})
+}
+
+func codecFor(m Message) (*Codec, bool) {
+	codec, ok := encoders[reflect.TypeOf(m)]
+	return codec, ok
+}
+
+func SendMessage(conn net.Conn, m Message) error {
+	codec, ok := codecFor(m)
+	if !ok {
+		return ErrUnknownMessageType
+	}
+	return codec.Encode(conn, m)
+}
+
+func init() {
+	RegisterMessage(TypeServiceRequest, &ServiceRequest{})
+	RegisterMessage(TypeServiceResponse, &ServiceResponse{})
+	RegisterMessage(TypeConnectRequest, &ConnectRequest{})
+	RegisterMessage(TypeConnectResponse, &ConnectResponse{})
+	RegisterCodec(&BinDataRequestWrapper{}, &Codec{
+		Type:   TypeBinData,
+		Decode: ParseDataMessage,
+		Encode: func(conn net.Conn, m Message) error {
+			v := m.(*BinDataRequestWrapper)
+			if v.Sid != 0 {
+				return WriteDataFrame(conn, v)
+			}
+			return WriteDataMessage(conn, TypeBinData, v.BinDataRequest, v.Content)
+		},
+	})
+	RegisterMessage(TypeCloseRequest, &CloseRequest{})
+	RegisterMessage(TypeHearBeatRequest, &HearBeatRequest{})
+	RegisterMessage(TypeHearBeatResp, &HearBeatResponse{})
+	RegisterMessage(TypeAckRequest, &AckRequest{})
+	RegisterMessage(TypeWindowUpdate, &WindowUpdate{})
+	RegisterCodec(nil, &Codec{
+		Type: TypeDataFrame,
+		Decode: func(body []byte) (Message, error) {
+			return ParseDataFrame(body)
+		},
+	})
+	RegisterMessage(TypeHelloRequest, &HelloRequest{})
+	RegisterMessage(TypeHelloResponse, &HelloResponse{})
+	RegisterMessage(TypeRateLimitReq, &RateLimitRequest{})
+	RegisterMessage(TypeRateLimitResp, &RateLimitResponse{})
+}
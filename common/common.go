@@ -1,6 +1,7 @@
 package common
 
 import (
+	"bean/handler"
 	"bufio"
 	"bytes"
 	"encoding/binary"
@@ -14,27 +15,63 @@ import (
 )
 
 type JoinWriter struct {
-	Id     string
-	Name   string
-	Sender net.Conn
+	Id       string
+	Sid      uint32
+	Name     string
+	Sender   *Outbox
+	Window   *SendWindow
+	Compress bool
+	Datagram bool
+	Stats    *CompressionStats
+	Limiters []*TokenBucket
 }
 
 func (b *JoinWriter) Write(p []byte) (n int, err error) {
-	dtReq := &BinDataRequestWrapper{
-		BinDataRequest: BinDataRequest{
-			Id:   b.Id,
-			Name: b.Name,
-		},
-		Content: p,
+	if b.Datagram && b.Window != nil && !b.Window.TryAcquire(len(p)) {
+		handler.Debugf("drop datagram of %d bytes on stream %s, window full", len(p), b.Id)
+		return len(p), nil
 	}
-	messageType := ParseMessageType(dtReq)
-	err = WriteMessageByType(b.Sender, int8(messageType), dtReq)
-	return len(p), err
+	for n < len(p) {
+		size := len(p) - n
+		if b.Window != nil && !b.Datagram {
+			size, err = b.Window.Acquire(size)
+			if err != nil {
+				return n, err
+			}
+		}
+		WaitBuckets(b.Limiters, size)
+		content := make([]byte, size)
+		copy(content, p[n:n+size])
+		compressed := false
+		if b.Compress {
+			content, compressed = CompressPayload(content)
+		}
+		if b.Stats != nil {
+			b.Stats.Add(size, len(content))
+		}
+		dtReq := &BinDataRequestWrapper{
+			BinDataRequest: BinDataRequest{
+				Id:         b.Id,
+				Sid:        b.Sid,
+				Name:       b.Name,
+				Compressed: compressed,
+			},
+			Content: content,
+		}
+		err = b.Sender.Write(dtReq)
+		if err != nil {
+			return n, err
+		}
+		n += size
+	}
+	return n, nil
 }
 
 type BeanReaderWriter interface {
 	Close()
+	Done() <-chan struct{}
 	WorkConn() net.Conn
+	Sender() *Outbox
 	ReaderCh() chan Message
 	SenderCh() chan Message
 }
@@ -44,13 +81,12 @@ func MessageWriter(rwx BeanReaderWriter) {
 		rwx.Close()
 	}()
 	for {
-		m, ok := <-rwx.SenderCh()
-		if !ok {
+		select {
+		case <-rwx.Done():
 			return
-		} else {
-			fmt.Printf("write message: %+v \r\n", m)
-			messageType := ParseMessageType(m)
-			err := WriteMessageByType(rwx.WorkConn(), int8(messageType), m)
+		case m := <-rwx.SenderCh():
+			handler.Debugf("write message %T", m)
+			err := rwx.Sender().Write(m)
 			if err != nil {
 				return
 			}
@@ -65,7 +101,6 @@ func MessageReader(rwx BeanReaderWriter) {
 	for {
 		m, err := ReadMessageWait(rwx.WorkConn())
 		if nil != err {
-			rwx.Close()
 			if err == io.EOF {
 				fmt.Printf("read chan eof  %v: \r\n", err)
 				return
@@ -74,58 +109,173 @@ func MessageReader(rwx BeanReaderWriter) {
 			return
 		}
 		message, err := ParseMessage(m)
+		if err == ErrUnknownMessageType {
+			handler.Warnf("skip unknown message type %d, length %d", m.Type, m.Length)
+			continue
+		}
 		if err != nil {
 			fmt.Printf("message err %v: \r\n", err)
 			continue
-		} else {
-			rwx.ReaderCh() <- message
+		}
+		select {
+		case rwx.ReaderCh() <- message:
+		case <-rwx.Done():
+			return
 		}
 	}
 }
 
+type TimeoutConn struct {
+	net.Conn
+	ReadTimeout time.Duration
+}
+
+func (c *TimeoutConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+	return c.Conn.Read(p)
+}
+
 type Message interface {
 }
 
 type ServiceRequest struct {
-	Id          string        `json:"id"`
-	ServiceList []ServiceBody `json:"service_list"`
-	ReqTime     time.Time     `json:"req_time"`
+	Id          string         `json:"id"`
+	User        string         `json:"user,omitempty"`
+	Token       string         `json:"token,omitempty"`
+	Secret      string         `json:"secret,omitempty"`
+	ServiceList []ServiceBody  `json:"service_list"`
+	ReqTime     time.Time      `json:"req_time"`
+	Resume      *ResumeRequest `json:"resume,omitempty"`
+}
+
+type ResumeRequest struct {
+	Session string `json:"session"`
+	RecvSeq uint64 `json:"recv_seq"`
+}
+
+const (
+	ProtocolTCP   = "tcp"
+	ProtocolUDP   = "udp"
+	ProtocolHTTP  = "http"
+	ProtocolHTTPS = "https"
+)
+
+func NormalizeProtocol(s string) string {
+	if s == "" {
+		return ProtocolTCP
+	}
+	return s
+}
+
+func ValidProtocol(s string) bool {
+	s = NormalizeProtocol(s)
+	return s == ProtocolTCP || s == ProtocolUDP || s == ProtocolHTTP || s == ProtocolHTTPS
+}
+
+func IsVhostProtocol(s string) bool {
+	return s == ProtocolHTTP || s == ProtocolHTTPS
+}
+
+func DialNetwork(protocol string) string {
+	if protocol == ProtocolUDP {
+		return "udp"
+	}
+	return "tcp"
 }
 
 type ServiceBody struct {
-	Name       string `json:"name"`
-	RemotePort int    `json:"remote_port"`
+	Name        string     `json:"name"`
+	Protocol    string     `json:"protocol,omitempty"`
+	RemotePort  PortRange  `json:"remote_port"`
+	Domains     []string   `json:"domains,omitempty"`
+	Compression string     `json:"compression,omitempty"`
+	AllowIPs    []string   `json:"allow_ips,omitempty"`
+	DenyIPs     []string   `json:"deny_ips,omitempty"`
+	RateLimit   *RateLimit `json:"rate_limit,omitempty"`
+	ConnLimit   *ConnLimit `json:"conn_limit,omitempty"`
 }
 
+const (
+	ReasonAuthFailed = "auth_failed"
+	ReasonBindFailed = "bind_failed"
+	ReasonForbidden  = "forbidden"
+	ReasonRolledBack = "rolled_back"
+	ReasonKicked     = "kicked"
+	ReasonInUse      = "in_use"
+)
+
 type ServiceResponse struct {
-	Id      string `json:"id"`
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Id         string          `json:"id"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Reason     string          `json:"reason,omitempty"`
+	Services   []ServiceStatus `json:"services,omitempty"`
+	Session    string          `json:"session,omitempty"`
+	Resumed    bool            `json:"resumed,omitempty"`
+	RecvSeq    uint64          `json:"recv_seq,omitempty"`
+	RetryAfter int             `json:"retry_after,omitempty"`
+}
+
+type ServiceStatus struct {
+	Name        string     `json:"name"`
+	Protocol    string     `json:"protocol,omitempty"`
+	RemotePort  int        `json:"remote_port"`
+	BindAddr    string     `json:"bind_addr,omitempty"`
+	Success     bool       `json:"success"`
+	Reason      string     `json:"reason,omitempty"`
+	Message     string     `json:"message,omitempty"`
+	Domains     []string   `json:"domains,omitempty"`
+	Compression string     `json:"compression,omitempty"`
+	RateLimit   *RateLimit `json:"rate_limit,omitempty"`
+	ConnLimit   *ConnLimit `json:"conn_limit,omitempty"`
 }
 
 type ConnectRequest struct {
+	Seq
 	Id   string `json:"id"`
+	Sid  uint32 `json:"sid,omitempty"`
 	Name string `json:"name"`
 	Ip   string `json:"ip"`
+	Dst  string `json:"dst,omitempty"`
 }
 
 type ConnectResponse struct {
+	Seq
 	Id      string `json:"id"`
+	Sid     uint32 `json:"sid,omitempty"`
 	Name    string `json:"name"`
 	Success bool   `json:"success"`
 }
 
 type BinDataRequest struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
+	Seq
+	Id         string `json:"id"`
+	Sid        uint32 `json:"sid,omitempty"`
+	Name       string `json:"name"`
+	Compressed bool   `json:"compressed,omitempty"`
 }
 
 type BinDataRequestWrapper struct {
 	BinDataRequest
 	Content []byte
+	Wire    int
+}
+
+func (b *BinDataRequestWrapper) inflate() error {
+	b.Wire = len(b.Content)
+	if !b.Compressed {
+		return nil
+	}
+	content, err := DecompressPayload(b.Content)
+	if err != nil {
+		return err
+	}
+	b.Content = content
+	return nil
 }
 
 type CloseRequest struct {
+	Seq
 	Id   string `json:"id"`
 	Name string `json:"name"`
 }
@@ -138,13 +288,35 @@ type HearBeatResponse struct {
 	Cid string
 }
 
+const HeartbeatInterval = 10 * time.Second
+
+type AckRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+type WindowUpdate struct {
+	Seq
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Credit int    `json:"credit"`
+}
+
 type RawMessage struct {
 	Type   byte
 	Body   []byte
 	Length int32
 }
 
+const (
+	MaxMessageSize   = 100 * 1024 * 1024
+	MaxHandshakeSize = 64 << 10
+)
+
 func ReadMessageWait(conn net.Conn) (*RawMessage, error) {
+	return ReadMessageLimit(conn, MaxMessageSize)
+}
+
+func ReadMessageLimit(conn net.Conn, limit int32) (*RawMessage, error) {
 	buffer := make([]byte, 1)
 	_, err := conn.Read(buffer)
 	if err != nil {
@@ -158,11 +330,11 @@ func ReadMessageWait(conn net.Conn) (*RawMessage, error) {
 		fmt.Println("rr2 io.eof")
 		return nil, err
 	}
-	if length < 0 || length > 100*1024*1024 {
+	if length < 0 || length > limit {
 		fmt.Println("rr3 length error")
 		return nil, errors.New("package size limit")
 	}
-	fmt.Printf("read message type = %d, message length = %d \r\n", typ, length)
+	handler.Debugf("read message type = %d, message length = %d", typ, length)
 	bufBody := make([]byte, length)
 	_, err = io.ReadFull(conn, bufBody)
 	if nil != err {
@@ -177,14 +349,6 @@ func ReadMessageWait(conn net.Conn) (*RawMessage, error) {
 	return raw, nil
 }
 
-func WriteMessageByType(conn net.Conn, typ int8, msg Message) (err error) {
-	if typ == 5 {
-		v := msg.(*BinDataRequestWrapper)
-		return WriteDataMessage(conn, typ, v.BinDataRequest, v.Content)
-	} else {
-		return WriteMessage(conn, typ, msg)
-	}
-}
 func WriteDataMessage(conn net.Conn, typ int8, data Message, buf []byte) (err error) {
 	bytePack, err := json.Marshal(data)
 	if err != nil {
@@ -233,7 +397,7 @@ func WriteMessage(conn net.Conn, typ int8, data Message) (err error) {
 	}
 	writer.Write(bytePack)
 	writer.Flush()
-	fmt.Printf("write message type = %d, message length = %d \r\n", typ, length)
+	handler.Debugf("write message type = %d, message length = %d", typ, length)
 	bytLen := len(buffer.Bytes())
 	n, err := conn.Write(buffer.Bytes())
 	if n != bytLen {
@@ -243,104 +407,53 @@ func WriteMessage(conn net.Conn, typ int8, data Message) (err error) {
 }
 
 func ParseMessage(rawMessage *RawMessage) (Message, error) {
-	v := int(rawMessage.Type)
-	switch v {
-	case 1:
-		var prReq ServiceRequest
-		err := json.Unmarshal(rawMessage.Body, &prReq)
-		return &prReq, err
-	case 2:
-		var prResp ServiceResponse
-		err := json.Unmarshal(rawMessage.Body, &prResp)
-		return &prResp, err
-	case 3:
-		var crReq ConnectRequest
-		err := json.Unmarshal(rawMessage.Body, &crReq)
-		return &crReq, err
-	case 4:
-		var crResp ConnectResponse
-		err := json.Unmarshal(rawMessage.Body, &crResp)
-		return &crResp, err
-	case 5:
-		buffer := bytes.NewBuffer(rawMessage.Body)
-		var jsonLen, binLen int32
-		err := binary.Read(buffer, binary.LittleEndian, &jsonLen)
-		if nil != err {
-			fmt.Println(err)
-			return nil, err
-		}
-		err = binary.Read(buffer, binary.LittleEndian, &binLen)
-		if nil != err {
-			fmt.Println(err)
-			return nil, err
-		}
-		jsonBuf := make([]byte, jsonLen)
-		_, err = buffer.Read(jsonBuf)
-		if nil != err {
-			fmt.Println(err)
-			return nil, err
-		}
-		var dtResp BinDataRequest
-		err = json.Unmarshal(jsonBuf, &dtResp)
-		if nil != err {
-			fmt.Println(err)
-			return nil, err
-		}
-		binBuf := make([]byte, binLen)
-		_, err = buffer.Read(binBuf)
-		if nil != err {
-			fmt.Println(err)
-			return nil, err
-		}
-		binWrapper := BinDataRequestWrapper{
-			BinDataRequest: dtResp,
-			Content:        binBuf,
-		}
-		err = json.Unmarshal(jsonBuf, &dtResp)
-		if nil != err {
-			fmt.Println(err)
-			return nil, err
-		}
-		return &binWrapper, err
-	case 6:
-		var closeReq CloseRequest
-		err := json.Unmarshal(rawMessage.Body, &closeReq)
-		return &closeReq, err
-	case 7:
-		var hearBeatReq HearBeatRequest
-		err := json.Unmarshal(rawMessage.Body, &hearBeatReq)
-		return &hearBeatReq, err
-	case 8:
-		var hearBeatResp HearBeatResponse
-		err := json.Unmarshal(rawMessage.Body, &hearBeatResp)
-		return &hearBeatResp, err
-	default:
-		return nil, errors.New("notype")
+	codec, ok := decoders[rawMessage.Type]
+	if !ok {
+		return nil, ErrUnknownMessageType
 	}
+	return codec.Decode(rawMessage.Body)
 }
 
-func ParseMessageType(message interface{}) int {
-	switch v := message.(type) {
-	case *ServiceRequest:
-		return 1
-	case *ServiceResponse:
-		return 2
-	case *ConnectRequest:
-		return 3
-	case *ConnectResponse:
-		return 4
-	case *BinDataRequest:
-		return 5
-	case *BinDataRequestWrapper:
-		return 5
-	case *CloseRequest:
-		return 6
-	case *HearBeatRequest:
-		return 7
-	case *HearBeatResponse:
-		return 8
-	default:
-		fmt.Println(v)
-		return -1
+func ParseDataMessage(body []byte) (Message, error) {
+	buffer := bytes.NewBuffer(body)
+	var jsonLen, binLen int32
+	err := binary.Read(buffer, binary.LittleEndian, &jsonLen)
+	if nil != err {
+		fmt.Println(err)
+		return nil, err
+	}
+	err = binary.Read(buffer, binary.LittleEndian, &binLen)
+	if nil != err {
+		fmt.Println(err)
+		return nil, err
+	}
+	if jsonLen < 0 || binLen < 0 || int64(jsonLen)+int64(binLen) > int64(len(body)-8) {
+		return nil, errors.New("data message length out of range")
+	}
+	jsonBuf := make([]byte, jsonLen)
+	_, err = buffer.Read(jsonBuf)
+	if nil != err {
+		fmt.Println(err)
+		return nil, err
+	}
+	var dtResp BinDataRequest
+	err = json.Unmarshal(jsonBuf, &dtResp)
+	if nil != err {
+		fmt.Println(err)
+		return nil, err
+	}
+	binBuf := make([]byte, binLen)
+	_, err = buffer.Read(binBuf)
+	if nil != err {
+		fmt.Println(err)
+		return nil, err
+	}
+	binWrapper := BinDataRequestWrapper{
+		BinDataRequest: dtResp,
+		Content:        binBuf,
+	}
+	if err = binWrapper.inflate(); err != nil {
+		return nil, err
 	}
+	return &binWrapper, nil
 }
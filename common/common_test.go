@@ -0,0 +1,52 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestParseDataMessageLengths(t *testing.T) {
+	data := &BinDataRequest{Id: "a", Name: "svc"}
+	conn := &bufConn{}
+	if err := WriteDataMessage(conn, TypeBinData, data, payload(100)); err != nil {
+		t.Fatal(err)
+	}
+	body := conn.raw(t).Body
+	if m, err := ParseDataMessage(body); err != nil || len(m.(*BinDataRequestWrapper).Content) != 100 {
+		t.Fatalf("ParseDataMessage = %v, %v", m, err)
+	}
+	header := func(jsonLen, binLen uint32) []byte {
+		b := append([]byte(nil), body...)
+		binary.LittleEndian.PutUint32(b[0:4], jsonLen)
+		binary.LittleEndian.PutUint32(b[4:8], binLen)
+		return b
+	}
+	jsonLen := binary.LittleEndian.Uint32(body[0:4])
+	cases := map[string][]byte{
+		"negative json":  header(0xffffffff, 100),
+		"negative bin":   header(jsonLen, 0x80000000),
+		"json too large": header(uint32(len(body)), 0),
+		"bin too large":  header(jsonLen, 101),
+		"huge both":      header(0x7fffffff, 0x7fffffff),
+		"short header":   body[:6],
+		"truncated body": body[:len(body)-1],
+	}
+	for name, b := range cases {
+		if _, err := ParseDataMessage(b); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestReadMessageLimit(t *testing.T) {
+	conn := &bufConn{}
+	WriteMessage(conn, TypeServiceRequest, &ServiceRequest{Id: "test", Token: string(payload(1024))})
+	wire := conn.buf.Bytes()
+	if _, err := ReadMessageLimit(&bufConn{buf: *bytes.NewBuffer(append([]byte(nil), wire...))}, 512); err == nil {
+		t.Error("oversized message accepted")
+	}
+	if raw, err := ReadMessageLimit(&bufConn{buf: *bytes.NewBuffer(wire)}, MaxHandshakeSize); err != nil || raw.Type != TypeServiceRequest {
+		t.Errorf("ReadMessageLimit = %v, %v", raw, err)
+	}
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	CompressionNone  = ""
+	CompressionFlate = "flate"
+
+	maxInflatedPayload = 1024 * 1024
+)
+
+var errPayloadTooLarge = errors.New("inflated payload too large")
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(ioutil.Discard, flate.BestSpeed)
+		return w
+	},
+}
+
+func ValidCompression(s string) bool {
+	return s == CompressionNone || s == "none" || s == CompressionFlate
+}
+
+func NormalizeCompression(s string) string {
+	if s == "none" {
+		return CompressionNone
+	}
+	return s
+}
+
+func CompressPayload(p []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(p); err != nil {
+		return p, false
+	}
+	if err := w.Close(); err != nil {
+		return p, false
+	}
+	if buf.Len() >= len(p) {
+		return p, false
+	}
+	return buf.Bytes(), true
+}
+
+func DecompressPayload(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, maxInflatedPayload+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxInflatedPayload {
+		return nil, errPayloadTooLarge
+	}
+	return out, nil
+}
+
+type CompressionStats struct {
+	raw  int64
+	wire int64
+}
+
+func (s *CompressionStats) Add(raw, wire int) {
+	atomic.AddInt64(&s.raw, int64(raw))
+	atomic.AddInt64(&s.wire, int64(wire))
+}
+
+func (s *CompressionStats) Raw() int64 {
+	return atomic.LoadInt64(&s.raw)
+}
+
+func (s *CompressionStats) Wire() int64 {
+	return atomic.LoadInt64(&s.wire)
+}
+
+func (s *CompressionStats) Ratio() float64 {
+	raw := s.Raw()
+	if raw == 0 {
+		return 1
+	}
+	return float64(s.Wire()) / float64(raw)
+}
+
+func (s *CompressionStats) String() string {
+	return fmt.Sprintf("raw %d bytes, wire %d bytes, ratio %.2f", s.Raw(), s.Wire(), s.Ratio())
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"errors"
+)
+
+const (
+	OverflowReject = "reject"
+	OverflowQueue  = "queue"
+
+	DefaultQueueTimeout = 10
+)
+
+type ConnLimit struct {
+	MaxConns      int    `json:"max_conns,omitempty"`
+	MaxConnsPerIP int    `json:"max_conns_per_ip,omitempty"`
+	Overflow      string `json:"overflow,omitempty"`
+	QueueTimeout  int    `json:"queue_timeout,omitempty"`
+}
+
+func (l *ConnLimit) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.MaxConns < 0 || l.MaxConnsPerIP < 0 || l.QueueTimeout < 0 {
+		return errors.New("connection limits must not be negative")
+	}
+	if l.Overflow != "" && l.Overflow != OverflowReject && l.Overflow != OverflowQueue {
+		return errors.New("overflow " + l.Overflow + " is not reject or queue")
+	}
+	return nil
+}
+
+func (l *ConnLimit) IsZero() bool {
+	return l == nil || l.MaxConns == 0 && l.MaxConnsPerIP == 0
+}
+
+func (l *ConnLimit) Queued() bool {
+	return l != nil && l.Overflow == OverflowQueue
+}
+
+func (l *ConnLimit) Timeout() int {
+	if l == nil || l.QueueTimeout <= 0 {
+		return DefaultQueueTimeout
+	}
+	return l.QueueTimeout
+}
+
+func capCount(n int, policy int) int {
+	if policy > 0 && (n <= 0 || n > policy) {
+		return policy
+	}
+	return n
+}
+
+func (l *ConnLimit) Cap(policy *ConnLimit) *ConnLimit {
+	limit := ConnLimit{}
+	if l != nil {
+		limit = *l
+	}
+	if policy != nil {
+		limit.MaxConns = capCount(limit.MaxConns, policy.MaxConns)
+		limit.MaxConnsPerIP = capCount(limit.MaxConnsPerIP, policy.MaxConnsPerIP)
+		limit.QueueTimeout = capCount(limit.QueueTimeout, policy.QueueTimeout)
+		if policy.Overflow != "" {
+			limit.Overflow = policy.Overflow
+		}
+	}
+	if limit.IsZero() {
+		return nil
+	}
+	return &limit
+}
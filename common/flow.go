@@ -0,0 +1,165 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	DefaultStreamWindow = 256 * 1024
+	windowUpdateBytes   = 32 * 1024
+)
+
+var ErrStreamClosed = errors.New("stream closed")
+
+type SendWindow struct {
+	credit int
+	closed bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func NewSendWindow(initial int) *SendWindow {
+	w := &SendWindow{credit: initial}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+func (w *SendWindow) Acquire(n int) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for w.credit <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+	if n > w.credit {
+		n = w.credit
+	}
+	w.credit -= n
+	return n, nil
+}
+
+func (w *SendWindow) TryAcquire(n int) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed || w.credit < n {
+		return false
+	}
+	w.credit -= n
+	return true
+}
+
+func (w *SendWindow) Grant(n int) {
+	w.mutex.Lock()
+	w.credit += n
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+}
+
+func (w *SendWindow) Close() {
+	w.mutex.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+}
+
+type StreamWriter struct {
+	conn    net.Conn
+	queue   [][]byte
+	queued  int
+	limit   int
+	closing bool
+	closed  bool
+	onWrite func(n int)
+	onError func(err error)
+	buckets []*TokenBucket
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+func NewStreamWriter(conn net.Conn, limit int, onWrite func(n int), onError func(err error)) *StreamWriter {
+	w := &StreamWriter{
+		conn:    conn,
+		queue:   make([][]byte, 0),
+		limit:   limit,
+		onWrite: onWrite,
+		onError: onError,
+	}
+	w.cond = sync.NewCond(&w.mutex)
+	go w.run()
+	return w
+}
+
+func (w *StreamWriter) Push(b []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed || w.closing {
+		return ErrStreamClosed
+	}
+	if w.queued+len(b) > w.limit {
+		return errors.New("stream window exceeded")
+	}
+	w.queue = append(w.queue, b)
+	w.queued += len(b)
+	w.cond.Signal()
+	return nil
+}
+
+func (w *StreamWriter) Limit(buckets []*TokenBucket) {
+	w.mutex.Lock()
+	w.buckets = buckets
+	w.mutex.Unlock()
+}
+
+func (w *StreamWriter) Close() {
+	w.mutex.Lock()
+	w.closing = true
+	w.cond.Signal()
+	w.mutex.Unlock()
+}
+
+func (w *StreamWriter) Abort() {
+	w.mutex.Lock()
+	w.closed = true
+	w.queue = nil
+	w.cond.Signal()
+	w.mutex.Unlock()
+	w.conn.Close()
+}
+
+func (w *StreamWriter) run() {
+	pending := 0
+	for {
+		w.mutex.Lock()
+		for len(w.queue) == 0 && !w.closing && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed || len(w.queue) == 0 {
+			w.closed = true
+			w.mutex.Unlock()
+			w.conn.Close()
+			return
+		}
+		b := w.queue[0]
+		w.queue = w.queue[1:]
+		w.queued -= len(b)
+		more := len(w.queue) > 0
+		buckets := w.buckets
+		w.mutex.Unlock()
+		WaitBuckets(buckets, len(b))
+		_, err := w.conn.Write(b)
+		if err != nil {
+			w.Abort()
+			w.onError(err)
+			return
+		}
+		pending += len(b)
+		if pending >= windowUpdateBytes || !more {
+			w.onWrite(pending)
+			pending = 0
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	DataFrameVersion = 2
+	dataFrameHeader  = 1 + 4 + 8
+
+	FrameFlagCompressed = 1 << 0
+)
+
+func WriteDataFrame(conn net.Conn, data *BinDataRequestWrapper) error {
+	header := dataFrameHeader
+	if data.Compressed {
+		header++
+	}
+	buf := make([]byte, 5+header+len(data.Content))
+	buf[0] = TypeDataFrame
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(header+len(data.Content)))
+	fields := buf[6:]
+	if data.Compressed {
+		buf[5] = DataFrameVersion
+		buf[6] = FrameFlagCompressed
+		fields = buf[7:]
+	} else {
+		buf[5] = 1
+	}
+	binary.LittleEndian.PutUint32(fields[0:4], data.Sid)
+	binary.LittleEndian.PutUint64(fields[4:12], data.GetSeq())
+	copy(fields[12:], data.Content)
+	_, err := conn.Write(buf)
+	return err
+}
+
+func ParseDataFrame(body []byte) (*BinDataRequestWrapper, error) {
+	if len(body) < dataFrameHeader {
+		return nil, errors.New("data frame too short")
+	}
+	var flags byte
+	fields := body[1:]
+	switch body[0] {
+	case 1:
+	case 2:
+		if len(body) < dataFrameHeader+1 {
+			return nil, errors.New("data frame too short")
+		}
+		flags = body[1]
+		fields = body[2:]
+	default:
+		return nil, errors.New("unsupported data frame version")
+	}
+	data := &BinDataRequestWrapper{
+		Content: fields[12:],
+	}
+	data.Sid = binary.LittleEndian.Uint32(fields[0:4])
+	data.SetSeq(binary.LittleEndian.Uint64(fields[4:12]))
+	data.Compressed = flags&FrameFlagCompressed != 0
+	if data.Sid == 0 {
+		return nil, errors.New("data frame without stream id")
+	}
+	if err := data.inflate(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,149 @@
+package common
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+type bufConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.buf.Read(p)
+}
+
+func (c *bufConn) raw(t testing.TB) *RawMessage {
+	raw, err := ReadMessageWait(c)
+	if err != nil {
+		t.Fatalf("ReadMessageWait: %v", err)
+	}
+	return raw
+}
+
+func payload(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i % 61)
+	}
+	return p
+}
+
+func TestDataFrameRoundTrip(t *testing.T) {
+	content := payload(16 * 1024)
+	compressed, ok := CompressPayload(content)
+	if !ok {
+		t.Fatal("payload did not compress")
+	}
+	cases := []struct {
+		name       string
+		content    []byte
+		compressed bool
+		version    byte
+	}{
+		{"v1 plain", content, false, 1},
+		{"v2 compressed", compressed, true, DataFrameVersion},
+		{"v1 empty", []byte{}, false, 1},
+	}
+	for _, c := range cases {
+		data := &BinDataRequestWrapper{Content: c.content}
+		data.Sid = 7
+		data.Compressed = c.compressed
+		data.SetSeq(42)
+		conn := &bufConn{}
+		if err := WriteDataFrame(conn, data); err != nil {
+			t.Fatalf("%s: WriteDataFrame: %v", c.name, err)
+		}
+		raw := conn.raw(t)
+		if raw.Type != TypeDataFrame || raw.Body[0] != c.version {
+			t.Fatalf("%s: type %d version %d", c.name, raw.Type, raw.Body[0])
+		}
+		got, err := ParseDataFrame(raw.Body)
+		if err != nil {
+			t.Fatalf("%s: ParseDataFrame: %v", c.name, err)
+		}
+		want := content
+		if len(c.content) == 0 {
+			want = c.content
+		}
+		if got.Sid != 7 || got.GetSeq() != 42 || !bytes.Equal(got.Content, want) {
+			t.Errorf("%s: got sid %d seq %d len %d", c.name, got.Sid, got.GetSeq(), len(got.Content))
+		}
+		if got.Wire != len(c.content) {
+			t.Errorf("%s: wire = %d, want %d", c.name, got.Wire, len(c.content))
+		}
+	}
+}
+
+func TestDataFrameTruncated(t *testing.T) {
+	compressed, _ := CompressPayload(payload(4096))
+	for _, c := range []struct {
+		name    string
+		content []byte
+		zipped  bool
+	}{
+		{"v1", payload(64), false},
+		{"v2", compressed, true},
+	} {
+		data := &BinDataRequestWrapper{Content: c.content}
+		data.Sid = 1
+		data.Compressed = c.zipped
+		conn := &bufConn{}
+		WriteDataFrame(conn, data)
+		body := conn.raw(t).Body
+		for _, n := range []int{0, 1, dataFrameHeader - 1} {
+			if _, err := ParseDataFrame(body[:n]); err == nil {
+				t.Errorf("%s: %d byte frame accepted", c.name, n)
+			}
+		}
+		if c.zipped {
+			if _, err := ParseDataFrame(body[:len(body)-8]); err == nil {
+				t.Errorf("%s: truncated compressed body accepted", c.name)
+			}
+		}
+	}
+	if _, err := ParseDataFrame([]byte{9, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}); err == nil {
+		t.Error("unknown frame version accepted")
+	}
+	if _, err := ParseDataFrame(make([]byte, dataFrameHeader)); err == nil {
+		t.Error("zero stream id accepted")
+	}
+}
+
+func BenchmarkDataMessage(b *testing.B) {
+	content := payload(16 * 1024)
+	data := &BinDataRequest{Id: "0123456789abcdef", Name: "bench"}
+	conn := &bufConn{}
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := WriteDataMessage(conn, TypeBinData, data, content); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ParseDataMessage(conn.raw(b).Body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDataFrame(b *testing.B) {
+	data := &BinDataRequestWrapper{Content: payload(16 * 1024)}
+	data.Sid = 1
+	conn := &bufConn{}
+	b.SetBytes(int64(len(data.Content)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := WriteDataFrame(conn, data); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ParseDataFrame(conn.raw(b).Body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"strconv"
+)
+
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
+
+const (
+	CapFlowControl  = "flow_control"
+	CapResume       = "resume"
+	CapBinaryFrames = "binary_frames"
+	CapCompression  = "compression"
+	CapEncryption   = "encryption"
+	CapRateLimit    = "rate_limit"
+)
+
+const ReasonIncompatible = "incompatible"
+
+var BuildVersion = "dev"
+
+var SupportedCapabilities = []string{CapFlowControl, CapResume, CapBinaryFrames, CapCompression, CapRateLimit}
+
+var RequiredCapabilities = []string{CapFlowControl}
+
+type HelloRequest struct {
+	Version      int      `json:"version"`
+	Build        string   `json:"build"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type HelloResponse struct {
+	Version      int      `json:"version"`
+	Build        string   `json:"build"`
+	Capabilities []string `json:"capabilities"`
+	Success      bool     `json:"success"`
+	Reason       string   `json:"reason,omitempty"`
+	Message      string   `json:"message,omitempty"`
+}
+
+func NewHelloRequest(encrypted bool) *HelloRequest {
+	caps := append([]string(nil), SupportedCapabilities...)
+	if encrypted {
+		caps = append(caps, CapEncryption)
+	}
+	return &HelloRequest{
+		Version:      ProtocolVersion,
+		Build:        BuildVersion,
+		Capabilities: caps,
+	}
+}
+
+func HasCapability(caps []string, c string) bool {
+	for _, item := range caps {
+		if item == c {
+			return true
+		}
+	}
+	return false
+}
+
+func Negotiate(req *HelloRequest, encrypted bool) *HelloResponse {
+	resp := &HelloResponse{
+		Version:      ProtocolVersion,
+		Build:        BuildVersion,
+		Capabilities: make([]string, 0),
+	}
+	if req.Version < MinProtocolVersion {
+		resp.Reason = ReasonIncompatible
+		resp.Message = "协议版本不兼容，客户端版本 " + strconv.Itoa(req.Version) + "，服务器至少需要 " + strconv.Itoa(MinProtocolVersion)
+		return resp
+	}
+	for _, c := range SupportedCapabilities {
+		if HasCapability(req.Capabilities, c) {
+			resp.Capabilities = append(resp.Capabilities, c)
+		}
+	}
+	for _, c := range RequiredCapabilities {
+		if !HasCapability(resp.Capabilities, c) {
+			resp.Reason = ReasonIncompatible
+			resp.Message = "协议不兼容，客户端缺少能力 " + c
+			return resp
+		}
+	}
+	if HasCapability(req.Capabilities, CapEncryption) != encrypted {
+		resp.Reason = ReasonIncompatible
+		resp.Message = "预共享密钥加密配置不一致，请检查客户端和服务器的 psk"
+		return resp
+	}
+	if encrypted {
+		resp.Capabilities = append(resp.Capabilities, CapEncryption)
+	}
+	resp.Success = true
+	return resp
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestNegotiateEncryption(t *testing.T) {
+	cases := []struct {
+		name               string
+		client, server     bool
+		success, hasCapEnc bool
+	}{
+		{"both plain", false, false, true, false},
+		{"both psk", true, true, true, true},
+		{"client psk only", true, false, false, false},
+		{"server psk only", false, true, false, false},
+	}
+	for _, c := range cases {
+		resp := Negotiate(NewHelloRequest(c.client), c.server)
+		if resp.Success != c.success {
+			t.Errorf("%s: success = %v, reason %q", c.name, resp.Success, resp.Message)
+		}
+		if HasCapability(resp.Capabilities, CapEncryption) != c.hasCapEnc {
+			t.Errorf("%s: capabilities = %v", c.name, resp.Capabilities)
+		}
+	}
+	if HasCapability(SupportedCapabilities, CapEncryption) {
+		t.Error("NewHelloRequest modified SupportedCapabilities")
+	}
+}
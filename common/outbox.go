@@ -0,0 +1,220 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	DefaultOutboxLimit = 4 * 1024 * 1024
+	ackEveryFrames     = 64
+	ackEveryBytes      = 256 * 1024
+)
+
+var ErrOutboxClosed = errors.New("outbox closed")
+
+type Sequenced interface {
+	GetSeq() uint64
+	SetSeq(seq uint64)
+}
+
+type Seq struct {
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+func (s *Seq) GetSeq() uint64 {
+	return s.Seq
+}
+
+func (s *Seq) SetSeq(seq uint64) {
+	s.Seq = seq
+}
+
+type Outbox struct {
+	conn         net.Conn
+	nextSeq      uint64
+	pending      []Message
+	pendingBytes int
+	queuedBytes  int
+	limit        int
+	recvSeq      uint64
+	recvFrames   int
+	recvBytes    int
+	closed       bool
+	sched        *FrameScheduler
+	mutex        sync.Mutex
+	writeMutex   sync.Mutex
+	cond         *sync.Cond
+}
+
+func NewOutbox(conn net.Conn, limit int) *Outbox {
+	o := &Outbox{
+		conn:    conn,
+		nextSeq: 1,
+		pending: make([]Message, 0),
+		limit:   limit,
+		sched:   NewFrameScheduler(),
+	}
+	o.cond = sync.NewCond(&o.mutex)
+	go o.run()
+	return o
+}
+
+func messageSize(m Message) int {
+	if v, ok := m.(*BinDataRequestWrapper); ok {
+		return len(v.Content) + 64
+	}
+	return 64
+}
+
+func (o *Outbox) Write(m Message) error {
+	_, stream := StreamKey(m)
+	o.mutex.Lock()
+	for stream && o.pendingBytes+o.queuedBytes >= o.limit && !o.closed {
+		o.cond.Wait()
+	}
+	if o.closed {
+		o.mutex.Unlock()
+		return ErrOutboxClosed
+	}
+	if stream {
+		o.queuedBytes += messageSize(m)
+	}
+	o.mutex.Unlock()
+	if !o.sched.Push(m) {
+		return ErrOutboxClosed
+	}
+	return nil
+}
+
+func (o *Outbox) run() {
+	for {
+		m, ok := o.sched.Pop()
+		if !ok {
+			return
+		}
+		o.writeMessage(m)
+	}
+}
+
+func (o *Outbox) writeMessage(m Message) {
+	o.writeMutex.Lock()
+	defer o.writeMutex.Unlock()
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return
+	}
+	if _, stream := StreamKey(m); stream {
+		o.queuedBytes -= messageSize(m)
+	}
+	if seqMsg, ok := m.(Sequenced); ok {
+		seqMsg.SetSeq(o.nextSeq)
+		o.nextSeq++
+		o.pending = append(o.pending, m)
+		o.pendingBytes += messageSize(m)
+	}
+	conn := o.conn
+	o.mutex.Unlock()
+	if conn == nil {
+		return
+	}
+	if err := SendMessage(conn, m); err != nil {
+		o.Detach(conn)
+	}
+}
+
+func (o *Outbox) Ack(seq uint64) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	n := 0
+	for n < len(o.pending) && o.pending[n].(Sequenced).GetSeq() <= seq {
+		o.pendingBytes -= messageSize(o.pending[n])
+		n++
+	}
+	if n > 0 {
+		o.pending = append(o.pending[:0], o.pending[n:]...)
+		o.cond.Broadcast()
+	}
+}
+
+func (o *Outbox) Detach(conn net.Conn) {
+	o.mutex.Lock()
+	if conn == nil || o.conn == conn {
+		o.conn = nil
+	}
+	o.mutex.Unlock()
+}
+
+func (o *Outbox) Resume(conn net.Conn, peerRecvSeq uint64, first Message) error {
+	o.Ack(peerRecvSeq)
+	o.writeMutex.Lock()
+	defer o.writeMutex.Unlock()
+	o.mutex.Lock()
+	if o.closed {
+		o.mutex.Unlock()
+		return ErrOutboxClosed
+	}
+	replay := make([]Message, len(o.pending))
+	copy(replay, o.pending)
+	o.conn = conn
+	o.mutex.Unlock()
+	if first != nil {
+		if err := SendMessage(conn, first); err != nil {
+			o.Detach(conn)
+			return err
+		}
+	}
+	for _, m := range replay {
+		if err := SendMessage(conn, m); err != nil {
+			o.Detach(conn)
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Outbox) Receive(m Message) (bool, *AckRequest) {
+	seqMsg, ok := m.(Sequenced)
+	if !ok || seqMsg.GetSeq() == 0 {
+		return true, nil
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if seqMsg.GetSeq() <= o.recvSeq {
+		return false, nil
+	}
+	o.recvSeq = seqMsg.GetSeq()
+	o.recvFrames++
+	o.recvBytes += messageSize(m)
+	if o.recvFrames >= ackEveryFrames || o.recvBytes >= ackEveryBytes {
+		o.recvFrames, o.recvBytes = 0, 0
+		return true, &AckRequest{Seq: o.recvSeq}
+	}
+	return true, nil
+}
+
+func (o *Outbox) RecvSeq() uint64 {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.recvSeq
+}
+
+func (o *Outbox) AckMessage() *AckRequest {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.recvFrames, o.recvBytes = 0, 0
+	return &AckRequest{Seq: o.recvSeq}
+}
+
+func (o *Outbox) Close() {
+	o.mutex.Lock()
+	o.closed = true
+	o.pending = nil
+	o.pendingBytes = 0
+	o.queuedBytes = 0
+	o.cond.Broadcast()
+	o.mutex.Unlock()
+	o.sched.Close()
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+type PortRange struct {
+	Start int
+	End   int
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Start && port <= r.End
+}
+
+func (r PortRange) IsAny() bool {
+	return r.Start == 0 && r.End == 0
+}
+
+func (r PortRange) IsSingle() bool {
+	return r.Start == r.End && r.Start != 0
+}
+
+func (r PortRange) MarshalJSON() ([]byte, error) {
+	if r.Start == r.End {
+		return json.Marshal(r.Start)
+	}
+	return json.Marshal(r.String())
+}
+
+func (r *PortRange) UnmarshalJSON(data []byte) error {
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		if port < 0 || port > 65535 {
+			return errors.New("invalid port " + strconv.Itoa(port))
+		}
+		r.Start, r.End = port, port
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("port must be a number or a range like 20000-20100")
+	}
+	parsed, err := ParsePortRange(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return strconv.Itoa(r.Start) + "-" + strconv.Itoa(r.End)
+}
+
+func ParsePortRange(s string) (PortRange, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.SplitN(s, "-", 2)
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return PortRange{}, errors.New("invalid port range " + s)
+	}
+	end := start
+	if len(parts) == 2 {
+		end, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return PortRange{}, errors.New("invalid port range " + s)
+		}
+	}
+	if start < 0 || end > 65535 || start > end || (start == 0 && end != 0) {
+		return PortRange{}, errors.New("invalid port range " + s)
+	}
+	return PortRange{Start: start, End: end}, nil
+}
+
+func ParsePortRanges(s string) ([]PortRange, error) {
+	ranges := make([]PortRange, 0)
+	for _, item := range strings.Split(s, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		r, err := ParsePortRange(item)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
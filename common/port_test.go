@@ -0,0 +1,83 @@
+package common
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	cases := []struct {
+		in    string
+		want  PortRange
+		valid bool
+	}{
+		{"3306", PortRange{3306, 3306}, true},
+		{" 20000 - 20100 ", PortRange{20000, 20100}, true},
+		{"0", PortRange{0, 0}, true},
+		{"65535", PortRange{65535, 65535}, true},
+		{"1-65535", PortRange{1, 65535}, true},
+		{"5-5", PortRange{5, 5}, true},
+		{"0-10", PortRange{}, false},
+		{"3-2", PortRange{}, false},
+		{"65536", PortRange{}, false},
+		{"100-65536", PortRange{}, false},
+		{"-1", PortRange{}, false},
+		{"", PortRange{}, false},
+		{"abc", PortRange{}, false},
+		{"10-", PortRange{}, false},
+		{"10-x", PortRange{}, false},
+	}
+	for _, c := range cases {
+		got, err := ParsePortRange(c.in)
+		if c.valid && (err != nil || got != c.want) {
+			t.Errorf("ParsePortRange(%q) = %v, %v, want %v", c.in, got, err, c.want)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("ParsePortRange(%q) = %v, want error", c.in, got)
+		}
+	}
+}
+
+func TestParsePortRanges(t *testing.T) {
+	ranges, err := ParsePortRanges("2000-3000, 3306,,")
+	if err != nil || len(ranges) != 2 || ranges[0] != (PortRange{2000, 3000}) || ranges[1] != (PortRange{3306, 3306}) {
+		t.Fatalf("ParsePortRanges = %v, %v", ranges, err)
+	}
+	if _, err := ParsePortRanges("2000-3000,3-2"); err == nil {
+		t.Fatal("ParsePortRanges accepted a reversed range")
+	}
+}
+
+func TestPortRangeJSON(t *testing.T) {
+	cases := []struct {
+		in    string
+		want  PortRange
+		valid bool
+	}{
+		{`3306`, PortRange{3306, 3306}, true},
+		{`"20000-20100"`, PortRange{20000, 20100}, true},
+		{`0`, PortRange{0, 0}, true},
+		{`65536`, PortRange{}, false},
+		{`-1`, PortRange{}, false},
+		{`"3-2"`, PortRange{}, false},
+		{`true`, PortRange{}, false},
+	}
+	for _, c := range cases {
+		var got PortRange
+		err := json.Unmarshal([]byte(c.in), &got)
+		if c.valid && (err != nil || got != c.want) {
+			t.Errorf("unmarshal %s = %v, %v, want %v", c.in, got, err, c.want)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("unmarshal %s = %v, want error", c.in, got)
+		}
+	}
+	out, _ := json.Marshal(PortRange{20000, 20100})
+	if string(out) != `"20000-20100"` {
+		t.Errorf("marshal range = %s", out)
+	}
+	out, _ = json.Marshal(PortRange{22, 22})
+	if string(out) != `22` {
+		t.Errorf("marshal single port = %s", out)
+	}
+}
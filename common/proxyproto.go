@@ -0,0 +1,77 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+func ValidProxyProtocol(s string) bool {
+	return s == "" || s == ProxyProtocolV1 || s == ProxyProtocolV2
+}
+
+func splitAddr(addr string) (net.IP, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, errors.New("invalid ip " + host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return nil, 0, errors.New("invalid port " + port)
+	}
+	return ip, p, nil
+}
+
+func BuildProxyHeader(version string, src string, dst string) ([]byte, error) {
+	srcIP, srcPort, srcErr := splitAddr(src)
+	dstIP, dstPort, dstErr := splitAddr(dst)
+	known := srcErr == nil && dstErr == nil && (srcIP.To4() == nil) == (dstIP.To4() == nil)
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		family := "TCP4"
+		if srcIP.To4() == nil {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP.String(), dstIP.String(), srcPort, dstPort)), nil
+	case ProxyProtocolV2:
+		var buf bytes.Buffer
+		buf.Write(proxyV2Signature)
+		if !known {
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+		buf.WriteByte(0x21)
+		if ip4 := srcIP.To4(); ip4 != nil {
+			buf.WriteByte(0x11)
+			binary.Write(&buf, binary.BigEndian, uint16(12))
+			buf.Write(ip4)
+			buf.Write(dstIP.To4())
+		} else {
+			buf.WriteByte(0x21)
+			binary.Write(&buf, binary.BigEndian, uint16(36))
+			buf.Write(srcIP.To16())
+			buf.Write(dstIP.To16())
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(srcPort))
+		binary.Write(&buf, binary.BigEndian, uint16(dstPort))
+		return buf.Bytes(), nil
+	}
+	return nil, errors.New("unknown proxy protocol version " + version)
+}
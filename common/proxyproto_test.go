@@ -0,0 +1,57 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func v2Header(body ...[]byte) []byte {
+	out := append([]byte(nil), proxyV2Signature...)
+	for _, b := range body {
+		out = append(out, b...)
+	}
+	return out
+}
+
+func TestBuildProxyHeader(t *testing.T) {
+	ip6src := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01}
+	ip6dst := []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02}
+	cases := []struct {
+		name     string
+		version  string
+		src, dst string
+		want     []byte
+	}{
+		{"v1 ipv4", ProxyProtocolV1, "192.0.2.1:51000", "10.0.0.2:19001",
+			[]byte("PROXY TCP4 192.0.2.1 10.0.0.2 51000 19001\r\n")},
+		{"v1 ipv6", ProxyProtocolV1, "[2001:db8::1]:51000", "[2001:db8::2]:19001",
+			[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 51000 19001\r\n")},
+		{"v1 ipv4-mapped", ProxyProtocolV1, "[::ffff:192.0.2.1]:51000", "10.0.0.2:19001",
+			[]byte("PROXY TCP4 192.0.2.1 10.0.0.2 51000 19001\r\n")},
+		{"v1 mixed family", ProxyProtocolV1, "192.0.2.1:51000", "[2001:db8::2]:19001",
+			[]byte("PROXY UNKNOWN\r\n")},
+		{"v1 bad address", ProxyProtocolV1, "pipe", "10.0.0.2:19001",
+			[]byte("PROXY UNKNOWN\r\n")},
+		{"v2 ipv4", ProxyProtocolV2, "192.0.2.1:51000", "10.0.0.2:19001",
+			v2Header([]byte{0x21, 0x11, 0x00, 0x0c, 192, 0, 2, 1, 10, 0, 0, 2, 0xc7, 0x38, 0x4a, 0x39})},
+		{"v2 ipv6", ProxyProtocolV2, "[2001:db8::1]:51000", "[2001:db8::2]:19001",
+			v2Header([]byte{0x21, 0x21, 0x00, 0x24}, ip6src, ip6dst, []byte{0xc7, 0x38, 0x4a, 0x39})},
+		{"v2 mixed family", ProxyProtocolV2, "[2001:db8::1]:51000", "10.0.0.2:19001",
+			v2Header([]byte{0x20, 0x00, 0x00, 0x00})},
+		{"v2 bad address", ProxyProtocolV2, "192.0.2.1:51000", "",
+			v2Header([]byte{0x20, 0x00, 0x00, 0x00})},
+	}
+	for _, c := range cases {
+		got, err := BuildProxyHeader(c.version, c.src, c.dst)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !bytes.Equal(got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+	if _, err := BuildProxyHeader("v3", "192.0.2.1:1", "10.0.0.2:2"); err == nil {
+		t.Error("unknown version accepted")
+	}
+}
@@ -0,0 +1,237 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	DefaultRekeyBytes = 1 << 30
+
+	pskMagic        = "BEANPSK1"
+	pskNonceSize    = 32
+	pskProofSize    = sha256.Size
+	pskRecordHeader = 1 + 4
+	pskMaxPlain     = 32 * 1024
+	pskFlagRekey    = 1 << 0
+)
+
+var (
+	ErrPSKRequired   = errors.New("peer did not start a pre-shared key handshake")
+	ErrPSKAuthFailed = errors.New("pre-shared key record authentication failed")
+	ErrPSKMismatch   = errors.New("pre-shared key mismatch, check psk on both sides")
+)
+
+type cipherState struct {
+	key     []byte
+	aead    cipher.AEAD
+	counter uint64
+	bytes   int64
+}
+
+func newCipherState(key []byte) (*cipherState, error) {
+	c := &cipherState{}
+	return c, c.setKey(key)
+}
+
+func (c *cipherState) setKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	c.key, c.aead, c.counter, c.bytes = key, aead, 0, 0
+	return nil
+}
+
+func (c *cipherState) rotate() error {
+	return c.setKey(pskMac(c.key, []byte("bean psk rekey")))
+}
+
+func (c *cipherState) nonce() []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.counter)
+	return nonce
+}
+
+func pskMac(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+type SecureConn struct {
+	net.Conn
+	send       *cipherState
+	recv       *cipherState
+	rekeyBytes int64
+	plain      []byte
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+}
+
+func pskProof(psk string, clientNonce, serverNonce []byte, label string) []byte {
+	return pskMac(pskMac([]byte(psk), clientNonce, serverNonce), []byte(label))
+}
+
+func newSecureConn(conn net.Conn, psk string, clientNonce, serverNonce []byte, rekeyBytes int64, isClient bool) (*SecureConn, error) {
+	if rekeyBytes <= 0 {
+		rekeyBytes = DefaultRekeyBytes
+	}
+	prk := pskMac([]byte(psk), clientNonce, serverNonce)
+	c2s, err := newCipherState(pskMac(prk, []byte("bean psk c2s")))
+	if err != nil {
+		return nil, err
+	}
+	s2c, err := newCipherState(pskMac(prk, []byte("bean psk s2c")))
+	if err != nil {
+		return nil, err
+	}
+	s := &SecureConn{Conn: conn, rekeyBytes: rekeyBytes}
+	if isClient {
+		s.send, s.recv = c2s, s2c
+	} else {
+		s.send, s.recv = s2c, c2s
+	}
+	return s, nil
+}
+
+func ClientPSKHandshake(conn net.Conn, psk string, rekeyBytes int64) (*SecureConn, error) {
+	clientNonce := make([]byte, pskNonceSize)
+	if _, err := rand.Read(clientNonce); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append([]byte(pskMagic), clientNonce...)); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, len(pskMagic)+pskNonceSize+pskProofSize)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, errors.New("psk handshake failed, is psk configured on the server? " + err.Error())
+	}
+	if string(reply[:len(pskMagic)]) != pskMagic {
+		return nil, errors.New("psk handshake failed, server did not answer with psk")
+	}
+	serverNonce := reply[len(pskMagic) : len(pskMagic)+pskNonceSize]
+	if !hmac.Equal(reply[len(pskMagic)+pskNonceSize:], pskProof(psk, clientNonce, serverNonce, "bean psk server")) {
+		return nil, ErrPSKMismatch
+	}
+	if _, err := conn.Write(pskProof(psk, clientNonce, serverNonce, "bean psk client")); err != nil {
+		return nil, err
+	}
+	return newSecureConn(conn, psk, clientNonce, serverNonce, rekeyBytes, true)
+}
+
+func ServerPSKHandshake(conn net.Conn, psk string, rekeyBytes int64) (*SecureConn, error) {
+	magic := make([]byte, len(pskMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != pskMagic {
+		return nil, ErrPSKRequired
+	}
+	clientNonce := make([]byte, pskNonceSize)
+	if _, err := io.ReadFull(conn, clientNonce); err != nil {
+		return nil, err
+	}
+	serverNonce := make([]byte, pskNonceSize)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	reply := append([]byte(pskMagic), serverNonce...)
+	if _, err := conn.Write(append(reply, pskProof(psk, clientNonce, serverNonce, "bean psk server")...)); err != nil {
+		return nil, err
+	}
+	proof := make([]byte, pskProofSize)
+	if _, err := io.ReadFull(conn, proof); err != nil {
+		return nil, ErrPSKMismatch
+	}
+	if !hmac.Equal(proof, pskProof(psk, clientNonce, serverNonce, "bean psk client")) {
+		return nil, ErrPSKMismatch
+	}
+	return newSecureConn(conn, psk, clientNonce, serverNonce, rekeyBytes, false)
+}
+
+func (s *SecureConn) Write(p []byte) (int, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	out := make([]byte, 0, len(p)+(len(p)/pskMaxPlain+1)*(pskRecordHeader+s.send.aead.Overhead()))
+	for n := 0; n < len(p); {
+		size := len(p) - n
+		if size > pskMaxPlain {
+			size = pskMaxPlain
+		}
+		var flags byte
+		if s.send.bytes >= s.rekeyBytes {
+			if err := s.send.rotate(); err != nil {
+				return 0, err
+			}
+			flags |= pskFlagRekey
+		}
+		header := make([]byte, pskRecordHeader)
+		header[0] = flags
+		binary.LittleEndian.PutUint32(header[1:], uint32(size+s.send.aead.Overhead()))
+		out = append(out, header...)
+		out = s.send.aead.Seal(out, s.send.nonce(), p[n:n+size], header)
+		s.send.counter++
+		s.send.bytes += int64(size)
+		n += size
+	}
+	if _, err := s.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *SecureConn) Read(p []byte) (int, error) {
+	s.readMutex.Lock()
+	defer s.readMutex.Unlock()
+	for len(s.plain) == 0 {
+		if err := s.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *SecureConn) readRecord() error {
+	header := make([]byte, pskRecordHeader)
+	if _, err := io.ReadFull(s.Conn, header); err != nil {
+		return err
+	}
+	length := int(binary.LittleEndian.Uint32(header[1:]))
+	if length < s.recv.aead.Overhead() || length > pskMaxPlain+s.recv.aead.Overhead() {
+		return ErrPSKAuthFailed
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.Conn, body); err != nil {
+		return err
+	}
+	if header[0]&pskFlagRekey != 0 {
+		if err := s.recv.rotate(); err != nil {
+			return err
+		}
+	}
+	plain, err := s.recv.aead.Open(body[:0], s.recv.nonce(), body, header)
+	if err != nil {
+		return ErrPSKAuthFailed
+	}
+	s.recv.counter++
+	s.recv.bytes += int64(len(plain))
+	s.plain = plain
+	return nil
+}
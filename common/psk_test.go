@@ -0,0 +1,125 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func pskPair(t *testing.T, clientPSK, serverPSK string, rekeyBytes int64) (*SecureConn, *SecureConn, error, error) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	type result struct {
+		conn *SecureConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := ServerPSKHandshake(b, serverPSK, rekeyBytes)
+		done <- result{conn, err}
+	}()
+	client, clientErr := ClientPSKHandshake(a, clientPSK, rekeyBytes)
+	if clientErr != nil {
+		a.Close()
+	}
+	server := <-done
+	return client, server.conn, clientErr, server.err
+}
+
+func TestPSKRoundTripRekey(t *testing.T) {
+	client, server, err1, err2 := pskPair(t, "0123456789abcdef", "0123456789abcdef", 4096)
+	if err1 != nil || err2 != nil {
+		t.Fatalf("handshake: %v, %v", err1, err2)
+	}
+	clientKey, serverKey := client.send.key, server.send.key
+	for _, pair := range []struct {
+		name string
+		w, r *SecureConn
+	}{
+		{"client to server", client, server},
+		{"server to client", server, client},
+	} {
+		sent := payload(100 * 1024)
+		written := make(chan struct{})
+		go func(w *SecureConn) {
+			defer close(written)
+			for n := 0; n < len(sent); n += 3000 {
+				end := n + 3000
+				if end > len(sent) {
+					end = len(sent)
+				}
+				w.Write(sent[n:end])
+			}
+		}(pair.w)
+		got := make([]byte, len(sent))
+		if _, err := io.ReadFull(pair.r, got); err != nil {
+			t.Fatalf("%s: read: %v", pair.name, err)
+		}
+		<-written
+		if !bytes.Equal(got, sent) {
+			t.Fatalf("%s: payload mismatch", pair.name)
+		}
+	}
+	if bytes.Equal(client.send.key, clientKey) || bytes.Equal(server.send.key, serverKey) {
+		t.Error("keys were not rotated")
+	}
+	if !bytes.Equal(client.send.key, server.recv.key) || !bytes.Equal(server.send.key, client.recv.key) {
+		t.Error("peers rotated to different keys")
+	}
+}
+
+func TestPSKMismatch(t *testing.T) {
+	_, _, clientErr, serverErr := pskPair(t, "0123456789abcdef", "fedcba9876543210", 0)
+	if clientErr != ErrPSKMismatch {
+		t.Errorf("client err = %v, want ErrPSKMismatch", clientErr)
+	}
+	if serverErr != ErrPSKMismatch {
+		t.Errorf("server err = %v, want ErrPSKMismatch", serverErr)
+	}
+}
+
+func securePair(rekeyBytes int64) (*SecureConn, *SecureConn, *bufConn, *bufConn) {
+	clientNonce, serverNonce := payload(pskNonceSize), payload(pskNonceSize)
+	wire, in := &bufConn{}, &bufConn{}
+	sender, _ := newSecureConn(wire, "0123456789abcdef", clientNonce, serverNonce, rekeyBytes, true)
+	receiver, _ := newSecureConn(in, "0123456789abcdef", clientNonce, serverNonce, rekeyBytes, false)
+	return sender, receiver, wire, in
+}
+
+func TestPSKTamperedRecord(t *testing.T) {
+	cases := map[string]func(record []byte){
+		"flipped payload": func(record []byte) { record[pskRecordHeader] ^= 1 },
+		"flipped tag":     func(record []byte) { record[len(record)-1] ^= 1 },
+		"rekey flag":      func(record []byte) { record[0] ^= pskFlagRekey },
+		"unknown flag":    func(record []byte) { record[0] |= 0x80 },
+	}
+	for name, tamper := range cases {
+		sender, receiver, wire, in := securePair(0)
+		sender.Write([]byte("hello bean"))
+		record := wire.buf.Bytes()
+		tamper(record)
+		in.buf.Write(record)
+		if _, err := receiver.Read(make([]byte, 64)); err != ErrPSKAuthFailed {
+			t.Errorf("%s: err = %v, want ErrPSKAuthFailed", name, err)
+		}
+	}
+}
+
+func TestPSKReplay(t *testing.T) {
+	sender, receiver, wire, in := securePair(0)
+	sender.Write([]byte("first"))
+	record := append([]byte(nil), wire.buf.Bytes()...)
+	in.buf.Write(record)
+	in.buf.Write(record)
+	buf := make([]byte, 64)
+	if n, err := receiver.Read(buf); err != nil || string(buf[:n]) != "first" {
+		t.Fatalf("first read = %q, %v", buf[:n], err)
+	}
+	if _, err := receiver.Read(buf); err != ErrPSKAuthFailed {
+		t.Errorf("replayed record err = %v, want ErrPSKAuthFailed", err)
+	}
+}
@@ -0,0 +1,217 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const maxRateWait = 100 * time.Millisecond
+
+type RateLimit struct {
+	Upload       int64 `json:"upload,omitempty"`
+	Download     int64 `json:"download,omitempty"`
+	ConnUpload   int64 `json:"conn_upload,omitempty"`
+	ConnDownload int64 `json:"conn_download,omitempty"`
+}
+
+func (r *RateLimit) Validate() error {
+	if r == nil {
+		return nil
+	}
+	if r.Upload < 0 || r.Download < 0 || r.ConnUpload < 0 || r.ConnDownload < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	return nil
+}
+
+func (r *RateLimit) IsZero() bool {
+	return r == nil || *r == RateLimit{}
+}
+
+func capRate(rate int64, policy int64) int64 {
+	if policy > 0 && (rate <= 0 || rate > policy) {
+		return policy
+	}
+	return rate
+}
+
+func (r *RateLimit) Cap(policy *RateLimit) *RateLimit {
+	limit := RateLimit{}
+	if r != nil {
+		limit = *r
+	}
+	if policy != nil {
+		limit.Upload = capRate(limit.Upload, policy.Upload)
+		limit.Download = capRate(limit.Download, policy.Download)
+		limit.ConnUpload = capRate(limit.ConnUpload, policy.ConnUpload)
+		limit.ConnDownload = capRate(limit.ConnDownload, policy.ConnDownload)
+	}
+	if limit.IsZero() {
+		return nil
+	}
+	return &limit
+}
+
+type TokenBucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func NewTokenBucket(rate int64) *TokenBucket {
+	return &TokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+}
+
+func (b *TokenBucket) SetRate(rate int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rate > 0 {
+		b.refill(time.Now())
+	}
+	b.rate = rate
+	b.last = time.Now()
+	if b.tokens > float64(rate) || rate <= 0 {
+		b.tokens = float64(rate)
+	}
+}
+
+func (b *TokenBucket) Rate() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.rate
+}
+
+// Wait lets a chunk through once the bucket is out of debt and then charges
+// it in full, so chunks larger than one second of rate still average out.
+func (b *TokenBucket) Wait(n int) {
+	for {
+		b.mutex.Lock()
+		if b.rate <= 0 {
+			b.mutex.Unlock()
+			return
+		}
+		b.refill(time.Now())
+		if b.tokens >= 0 {
+			b.tokens -= float64(n)
+			b.mutex.Unlock()
+			return
+		}
+		wait := time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+		b.mutex.Unlock()
+		if wait > maxRateWait {
+			wait = maxRateWait
+		}
+		time.Sleep(wait)
+	}
+}
+
+func WaitBuckets(buckets []*TokenBucket, n int) {
+	for _, b := range buckets {
+		if b != nil {
+			b.Wait(n)
+		}
+	}
+}
+
+type Shaper struct {
+	Upload   *TokenBucket
+	Download *TokenBucket
+	limit    RateLimit
+	conns    map[*ConnShaper]bool
+	mutex    sync.Mutex
+}
+
+type ConnShaper struct {
+	shaper   *Shaper
+	Upload   *TokenBucket
+	Download *TokenBucket
+}
+
+func NewShaper(limit *RateLimit) *Shaper {
+	s := &Shaper{
+		Upload:   NewTokenBucket(0),
+		Download: NewTokenBucket(0),
+		conns:    make(map[*ConnShaper]bool),
+	}
+	s.SetLimit(limit)
+	return s
+}
+
+func (s *Shaper) SetLimit(limit *RateLimit) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.limit = RateLimit{}
+	if limit != nil {
+		s.limit = *limit
+	}
+	s.Upload.SetRate(s.limit.Upload)
+	s.Download.SetRate(s.limit.Download)
+	for c := range s.conns {
+		c.Upload.SetRate(s.limit.ConnUpload)
+		c.Download.SetRate(s.limit.ConnDownload)
+	}
+}
+
+func (s *Shaper) Limit() *RateLimit {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	limit := s.limit
+	return &limit
+}
+
+func (s *Shaper) Open() *ConnShaper {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := &ConnShaper{
+		shaper:   s,
+		Upload:   NewTokenBucket(s.limit.ConnUpload),
+		Download: NewTokenBucket(s.limit.ConnDownload),
+	}
+	s.conns[c] = true
+	return c
+}
+
+func (c *ConnShaper) Release() {
+	if c == nil {
+		return
+	}
+	c.shaper.mutex.Lock()
+	delete(c.shaper.conns, c)
+	c.shaper.mutex.Unlock()
+}
+
+func (c *ConnShaper) UploadBuckets() []*TokenBucket {
+	if c == nil {
+		return nil
+	}
+	return []*TokenBucket{c.shaper.Upload, c.Upload}
+}
+
+func (c *ConnShaper) DownloadBuckets() []*TokenBucket {
+	if c == nil {
+		return nil
+	}
+	return []*TokenBucket{c.shaper.Download, c.Download}
+}
+
+type RateLimitRequest struct {
+	Name      string     `json:"name"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
+
+type RateLimitResponse struct {
+	Name      string     `json:"name"`
+	Success   bool       `json:"success"`
+	Message   string     `json:"message,omitempty"`
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"sync"
+)
+
+type FrameScheduler struct {
+	control [][]Message
+	streams map[string][]Message
+	ring    []string
+	next    int
+	closed  bool
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+const (
+	PriorityHigh = iota
+	PriorityNormal
+	priorityLevels
+)
+
+func NewFrameScheduler() *FrameScheduler {
+	s := &FrameScheduler{
+		control: make([][]Message, priorityLevels),
+		streams: make(map[string][]Message),
+		ring:    make([]string, 0),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+func StreamKey(m Message) (string, bool) {
+	switch v := m.(type) {
+	case *BinDataRequestWrapper:
+		return v.Id, true
+	case *CloseRequest:
+		return v.Id, true
+	}
+	return "", false
+}
+
+func FramePriority(m Message) int {
+	switch m.(type) {
+	case *HearBeatRequest, *HearBeatResponse, *AckRequest, *WindowUpdate:
+		return PriorityHigh
+	}
+	return PriorityNormal
+}
+
+func (s *FrameScheduler) Push(m Message) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return false
+	}
+	if key, ok := StreamKey(m); ok {
+		queue, active := s.streams[key]
+		s.streams[key] = append(queue, m)
+		if !active {
+			s.ring = append(s.ring, key)
+		}
+	} else {
+		p := FramePriority(m)
+		s.control[p] = append(s.control[p], m)
+	}
+	s.cond.Signal()
+	return true
+}
+
+func (s *FrameScheduler) Pop() (Message, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for !s.closed && len(s.ring) == 0 && !s.hasControl() {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, false
+	}
+	for p, queue := range s.control {
+		if len(queue) > 0 {
+			m := queue[0]
+			queue[0] = nil
+			s.control[p] = queue[1:]
+			return m, true
+		}
+	}
+	if s.next >= len(s.ring) {
+		s.next = 0
+	}
+	key := s.ring[s.next]
+	queue := s.streams[key]
+	m := queue[0]
+	queue[0] = nil
+	if len(queue) == 1 {
+		delete(s.streams, key)
+		s.ring = append(s.ring[:s.next], s.ring[s.next+1:]...)
+	} else {
+		s.streams[key] = queue[1:]
+		s.next++
+	}
+	return m, true
+}
+
+func (s *FrameScheduler) hasControl() bool {
+	for _, queue := range s.control {
+		if len(queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *FrameScheduler) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.streams = make(map[string][]Message)
+	s.ring = nil
+	s.control = make([][]Message, priorityLevels)
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+}
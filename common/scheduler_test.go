@@ -0,0 +1,116 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func dataFrame(id string, content string) *BinDataRequestWrapper {
+	m := &BinDataRequestWrapper{Content: []byte(content)}
+	m.Id = id
+	return m
+}
+
+func popAll(t *testing.T, s *FrameScheduler, n int) []Message {
+	out := make([]Message, 0, n)
+	for i := 0; i < n; i++ {
+		m, ok := s.Pop()
+		if !ok {
+			t.Fatalf("Pop %d returned closed", i)
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func describe(m Message) string {
+	switch v := m.(type) {
+	case *BinDataRequestWrapper:
+		return v.Id + ":" + string(v.Content)
+	case *CloseRequest:
+		return v.Id + ":close"
+	case *HearBeatRequest:
+		return "heartbeat"
+	case *AckRequest:
+		return "ack"
+	case *ConnectRequest:
+		return "connect"
+	}
+	return "unknown"
+}
+
+func TestSchedulerControlFirst(t *testing.T) {
+	s := NewFrameScheduler()
+	s.Push(dataFrame("a", "1"))
+	s.Push(&ConnectRequest{})
+	s.Push(dataFrame("b", "1"))
+	s.Push(&HearBeatRequest{})
+	s.Push(&AckRequest{Seq: 1})
+	want := []string{"heartbeat", "ack", "connect", "a:1", "b:1"}
+	for i, m := range popAll(t, s, len(want)) {
+		if got := describe(m); got != want[i] {
+			t.Errorf("pop %d = %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestSchedulerRoundRobin(t *testing.T) {
+	s := NewFrameScheduler()
+	for _, c := range []string{"1", "2", "3"} {
+		s.Push(dataFrame("a", c))
+	}
+	s.Push(dataFrame("b", "1"))
+	s.Push(dataFrame("b", "2"))
+	s.Push(dataFrame("c", "1"))
+	want := []string{"a:1", "b:1", "c:1", "a:2", "b:2", "a:3"}
+	for i, m := range popAll(t, s, len(want)) {
+		if got := describe(m); got != want[i] {
+			t.Errorf("pop %d = %s, want %s", i, got, want[i])
+		}
+	}
+}
+
+func TestSchedulerStreamOrder(t *testing.T) {
+	s := NewFrameScheduler()
+	s.Push(dataFrame("a", "1"))
+	s.Push(dataFrame("a", "2"))
+	s.Push(&CloseRequest{Id: "a", Name: "svc"})
+	s.Push(dataFrame("b", "1"))
+	got := make([]string, 0)
+	for _, m := range popAll(t, s, 4) {
+		if key, _ := StreamKey(m); key == "a" {
+			got = append(got, describe(m))
+		}
+	}
+	want := []string{"a:1", "a:2", "a:close"}
+	if len(got) != len(want) {
+		t.Fatalf("stream a = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("stream a = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSchedulerCloseUnblocksPop(t *testing.T) {
+	s := NewFrameScheduler()
+	done := make(chan bool)
+	go func() {
+		_, ok := s.Pop()
+		done <- ok
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("Pop returned a message after Close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not unblock Pop")
+	}
+	if s.Push(&HearBeatRequest{}) {
+		t.Fatal("Push succeeded after Close")
+	}
+}
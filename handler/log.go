@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevel = LevelInfo
+
+var levelNames = map[string]int{
+	"debug": LevelDebug,
+	"info":  LevelInfo,
+	"warn":  LevelWarn,
+	"error": LevelError,
+}
+
+func ParseLogLevel(level string) (int, error) {
+	v, ok := levelNames[strings.ToLower(strings.TrimSpace(level))]
+	if !ok {
+		return LevelInfo, errors.New("unknown log level " + level)
+	}
+	return v, nil
+}
+
+func SetLogLevel(level string) error {
+	v, err := ParseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	logLevel = v
+	return nil
+}
+
+func logf(level int, prefix string, format string, v ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	fmt.Printf(time.Now().Format("2006/01/02 15:04:05")+" ["+prefix+"] "+format+"\r\n", v...)
+}
+
+func Debugf(format string, v ...interface{}) {
+	logf(LevelDebug, "DEBUG", format, v...)
+}
+
+func Infof(format string, v ...interface{}) {
+	logf(LevelInfo, "INFO", format, v...)
+}
+
+func Warnf(format string, v ...interface{}) {
+	logf(LevelWarn, "WARN", format, v...)
+}
+
+func Errorf(format string, v ...interface{}) {
+	logf(LevelError, "ERROR", format, v...)
+}
@@ -1,9 +1,80 @@
 package main
 
 import (
+	"bean/common"
+	"bean/handler"
 	"bean/server"
+	"flag"
+	"fmt"
+	"os"
 )
 
 func main() {
-	server.Run()
+	configPath := flag.String("c", server.DefaultConfigPath, "server config file")
+	bindAddr := flag.String("bind", "", "control listen address, e.g. 0.0.0.0:8092")
+	proxyBindAddr := flag.String("proxy_bind", "", "interface the exposed services listen on")
+	allowPorts := flag.String("allow_ports", "", "remote port ranges clients may open, e.g. 2000-3000,3306")
+	heartbeatTimeout := flag.Int("heartbeat_timeout", 0, "seconds without heartbeat before a client is dropped")
+	logLevel := flag.String("log_level", "", "debug, info, warn or error")
+	bindPolicy := flag.String("bind_policy", "", "all_or_nothing or partial")
+	tlsEnable := flag.Bool("tls", false, "enable tls on the control listener")
+	tlsCertFile := flag.String("tls_cert", "", "tls certificate file")
+	tlsKeyFile := flag.String("tls_key", "", "tls private key file")
+	tlsAutoCert := flag.Bool("tls_auto_cert", false, "generate a self-signed certificate on start")
+	version := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+	if *version {
+		fmt.Printf("bean server %s protocol %d \r\n", common.BuildVersion, common.ProtocolVersion)
+		return
+	}
+
+	configRequired := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			configRequired = true
+		}
+	})
+	config, err := server.LoadServerConfig(*configPath, configRequired)
+	if err != nil {
+		fmt.Printf("load config error: %v \r\n", err)
+		os.Exit(1)
+	}
+	if err = config.ApplyEnv(); err != nil {
+		fmt.Printf("config env error: %v \r\n", err)
+		os.Exit(1)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bind":
+			config.BindAddr = *bindAddr
+		case "proxy_bind":
+			config.ProxyBindAddr = *proxyBindAddr
+		case "allow_ports":
+			config.AllowPorts = *allowPorts
+		case "heartbeat_timeout":
+			config.HeartbeatTimeout = *heartbeatTimeout
+		case "log_level":
+			config.LogLevel = *logLevel
+		case "bind_policy":
+			config.BindPolicy = *bindPolicy
+		case "tls":
+			config.TLSEnable = *tlsEnable
+		case "tls_cert":
+			config.TLSCertFile = *tlsCertFile
+		case "tls_key":
+			config.TLSKeyFile = *tlsKeyFile
+		case "tls_auto_cert":
+			config.TLSAutoCert = *tlsAutoCert
+		}
+	})
+	if err = config.Validate(); err != nil {
+		fmt.Printf("config error: %v \r\n", err)
+		os.Exit(1)
+	}
+	handler.SetLogLevel(config.LogLevel)
+	go server.WatchReload(*configPath, config)
+	if err = server.Run(config); err != nil {
+		fmt.Printf("server error: %v \r\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"bean/common"
+)
+
+type ServiceACL struct {
+	AllowIPs []string `json:"allow_ips"`
+	DenyIPs  []string `json:"deny_ips"`
+}
+
+func (c *BeanServerConfig) serviceACL(name string) *ServiceACL {
+	if acl, ok := c.ServiceACLs[name]; ok && acl != nil {
+		return acl
+	}
+	return c.ServiceACLs["*"]
+}
+
+func (s *BeanServer) serviceFilter(item common.ServiceBody) (*common.IPFilter, error) {
+	allow := item.AllowIPs
+	deny := item.DenyIPs
+	if acl := s.Config.serviceACL(item.Name); acl != nil {
+		if len(acl.AllowIPs) > 0 {
+			allow = acl.AllowIPs
+		}
+		deny = append(append([]string{}, deny...), acl.DenyIPs...)
+	}
+	return common.ParseIPFilter(allow, deny)
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bean/common"
+	"bean/handler"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kickRefuseTime    = 5 * time.Minute
+	adminReadTimeout  = 10 * time.Second
+	adminWriteTimeout = 30 * time.Second
+)
+
+type StreamView struct {
+	Sid      uint32    `json:"sid"`
+	Id       string    `json:"id"`
+	Visitor  string    `json:"visitor"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Created  time.Time `json:"created"`
+	Age      float64   `json:"age_seconds"`
+}
+
+type ServiceView struct {
+	Name      string            `json:"name"`
+	Protocol  string            `json:"protocol"`
+	BindAddr  string            `json:"bind_addr"`
+	Domains   []string          `json:"domains,omitempty"`
+	BytesIn   int64             `json:"bytes_in"`
+	BytesOut  int64             `json:"bytes_out"`
+	RateLimit *common.RateLimit `json:"rate_limit,omitempty"`
+	ConnLimit *common.ConnLimit `json:"conn_limit,omitempty"`
+	Streams   []StreamView      `json:"streams"`
+}
+
+type SessionView struct {
+	Key          string        `json:"key"`
+	Id           string        `json:"id"`
+	User         string        `json:"user,omitempty"`
+	Remote       string        `json:"remote"`
+	Build        string        `json:"build,omitempty"`
+	Capabilities []string      `json:"capabilities"`
+	Connected    time.Time     `json:"connected"`
+	LastActive   time.Time     `json:"last_active"`
+	Detached     bool          `json:"detached"`
+	Services     []ServiceView `json:"services"`
+}
+
+func (l *ListenerWrapper) View() ServiceView {
+	view := ServiceView{
+		Name:      l.Name,
+		Protocol:  l.Protocol,
+		BindAddr:  l.Listener.Addr().String(),
+		BytesIn:   l.Traffic.BytesIn(),
+		BytesOut:  l.Traffic.BytesOut(),
+		RateLimit: l.Shaper.Limit(),
+		ConnLimit: l.Gate.getLimit(),
+		Streams:   make([]StreamView, 0),
+	}
+	if view.RateLimit.IsZero() {
+		view.RateLimit = nil
+	}
+	if vhost, ok := l.Listener.(*vhostListener); ok {
+		view.Domains = vhost.Domains()
+	}
+	l.Mutex.Lock()
+	for _, c := range l.ClientMap {
+		view.Streams = append(view.Streams, StreamView{
+			Sid:      c.Sid,
+			Id:       c.Id,
+			Visitor:  c.Conn.RemoteAddr().String(),
+			BytesIn:  c.Traffic.BytesIn(),
+			BytesOut: c.Traffic.BytesOut(),
+			Created:  c.Created,
+			Age:      time.Since(c.Created).Seconds(),
+		})
+	}
+	l.Mutex.Unlock()
+	sort.Slice(view.Streams, func(i, j int) bool {
+		return view.Streams[i].Created.Before(view.Streams[j].Created)
+	})
+	return view
+}
+
+func (s *BeanServer) View() SessionView {
+	s.Mutex.Lock()
+	view := SessionView{
+		Key:          s.Key,
+		Id:           s.Id,
+		User:         s.ServiceReq.User,
+		Remote:       s.Conn.RemoteAddr().String(),
+		Capabilities: s.Caps,
+		Connected:    s.Connected,
+		LastActive:   s.LastActive,
+		Detached:     s.detached,
+		Services:     make([]ServiceView, 0, len(s.Listener)),
+	}
+	if s.HelloReq != nil {
+		view.Build = s.HelloReq.Build
+	}
+	wrappers := make([]*ListenerWrapper, 0, len(s.Listener))
+	for _, wrapper := range s.Listener {
+		wrappers = append(wrappers, wrapper)
+	}
+	s.Mutex.Unlock()
+	for _, wrapper := range wrappers {
+		view.Services = append(view.Services, wrapper.View())
+	}
+	sort.Slice(view.Services, func(i, j int) bool {
+		return view.Services[i].Name < view.Services[j].Name
+	})
+	return view
+}
+
+func (s *BeanServer) CloseStream(sid uint32) bool {
+	clientConn, ok := s.getStream(sid)
+	if !ok {
+		return false
+	}
+	name := clientConn.Wrapper.Name
+	clientConn.Wrapper.removeClientConn(clientConn.Id)
+	clientConn.Abort()
+	s.Outbox.Write(&common.CloseRequest{Id: clientConn.Id, Name: name})
+	return true
+}
+
+type adminServer struct {
+	token string
+}
+
+func startAdmin(config *BeanServerConfig) error {
+	listen, err := net.Listen("tcp", config.AdminAddr)
+	if err != nil {
+		return err
+	}
+	a := &adminServer{token: config.AdminToken}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/sessions", a.auth(a.listSessions))
+	mux.HandleFunc("/api/sessions/kick", a.auth(a.kickSession))
+	mux.HandleFunc("/api/streams/close", a.auth(a.closeStream))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: adminReadTimeout,
+		ReadTimeout:       adminReadTimeout,
+		WriteTimeout:      adminWriteTimeout,
+		IdleTimeout:       2 * adminWriteTimeout,
+	}
+	go func() {
+		err := server.Serve(listen)
+		handler.Warnf("admin api stopped: %v", err)
+	}()
+	handler.Infof("admin api listen to %s", listen.Addr().String())
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (a *adminServer) auth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			handler.Warnf("admin api from %s rejected, bad token", r.RemoteAddr)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (a *adminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	list := sessions.List()
+	views := make([]SessionView, 0, len(list))
+	for _, s := range list {
+		views = append(views, s.View())
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Key < views[j].Key
+	})
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (a *adminServer) kickSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	key := r.URL.Query().Get("key")
+	s, ok := sessions.Get(key)
+	if !ok {
+		writeError(w, http.StatusNotFound, "session not found: "+key)
+		return
+	}
+	handler.Infof("admin api kicked client %s from %s, refused for %v", s.Id, r.RemoteAddr, kickRefuseTime)
+	sessions.Kick(s, kickRefuseTime)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"kicked": key, "refused_seconds": int(kickRefuseTime.Seconds())})
+}
+
+func (a *adminServer) closeStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	sid, err := strconv.ParseUint(r.URL.Query().Get("sid"), 10, 32)
+	if err != nil || sid == 0 {
+		writeError(w, http.StatusBadRequest, "sid must be a stream id")
+		return
+	}
+	clientConn, ok := streams.Get(uint32(sid))
+	if !ok || !clientConn.Wrapper.owner().CloseStream(uint32(sid)) {
+		writeError(w, http.StatusNotFound, "stream not found: "+strconv.FormatUint(sid, 10))
+		return
+	}
+	handler.Infof("admin api closed stream %d of service %s from %s", sid, clientConn.Wrapper.Name, r.RemoteAddr)
+	writeJSON(w, http.StatusOK, map[string]uint64{"closed": sid})
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"os"
+	"strings"
+)
+
+type TokenStore interface {
+	Verify(user string, token string) bool
+}
+
+type openTokenStore struct {
+}
+
+func (s *openTokenStore) Verify(user string, token string) bool {
+	return true
+}
+
+type sharedTokenStore struct {
+	token string
+}
+
+func (s *sharedTokenStore) Verify(user string, token string) bool {
+	return tokenEqual(s.token, token)
+}
+
+type userTokenStore struct {
+	tokens map[string]string
+	shared string
+}
+
+func (s *userTokenStore) Verify(user string, token string) bool {
+	if expected, ok := s.tokens[user]; ok && user != "" {
+		return tokenEqual(expected, token)
+	}
+	return s.shared != "" && tokenEqual(s.shared, token)
+}
+
+func tokenEqual(expected string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+func NewTokenStore(config *BeanServerConfig) (TokenStore, error) {
+	tokens := make(map[string]string)
+	for user, token := range config.Tokens {
+		tokens[user] = token
+	}
+	if config.TokenFile != "" {
+		err := loadTokenFile(config.TokenFile, tokens)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(tokens) > 0 {
+		return &userTokenStore{tokens: tokens, shared: config.Token}, nil
+	}
+	if config.Token != "" {
+		return &sharedTokenStore{token: config.Token}, nil
+	}
+	return &openTokenStore{}, nil
+}
+
+func loadTokenFile(path string, tokens map[string]string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return errors.New("token file " + path + " line must be user:token")
+		}
+		tokens[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bean/common"
+	"bean/handler"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultConfigPath = "./config/server.json"
+
+const (
+	BindPolicyAllOrNothing = "all_or_nothing"
+	BindPolicyPartial      = "partial"
+)
+
+type BeanServerConfig struct {
+	BindAddr         string `json:"bind_addr"`
+	ProxyBindAddr    string `json:"proxy_bind_addr"`
+	AllowPorts       string `json:"allow_ports"`
+	PortPool         string `json:"port_pool"`
+	HeartbeatTimeout int    `json:"heartbeat_timeout"`
+	ResumeTimeout    int    `json:"resume_timeout"`
+	LogLevel         string `json:"log_level"`
+	BindPolicy       string `json:"bind_policy"`
+	UDPIdleTimeout   int    `json:"udp_idle_timeout"`
+	VhostHTTPAddr    string `json:"vhost_http_addr"`
+	VhostHTTPSAddr   string `json:"vhost_https_addr"`
+	AdminAddr        string `json:"admin_addr"`
+	AdminToken       string `json:"admin_token"`
+
+	Token     string            `json:"token"`
+	Tokens    map[string]string `json:"tokens"`
+	TokenFile string            `json:"token_file"`
+
+	TLSEnable        bool     `json:"tls_enable"`
+	TLSCertFile      string   `json:"tls_cert_file"`
+	TLSKeyFile       string   `json:"tls_key_file"`
+	TLSAutoCert      bool     `json:"tls_auto_cert"`
+	TLSAutoCertHosts []string `json:"tls_auto_cert_hosts"`
+	TLSAutoCertDir   string   `json:"tls_auto_cert_dir"`
+	TLSClientCAFile  string   `json:"tls_client_ca_file"`
+
+	PSK           string `json:"psk"`
+	PSKRekeyBytes int64  `json:"psk_rekey_bytes"`
+
+	ClientIdentities map[string]*ClientIdentity `json:"client_identities"`
+	ServiceACLs      map[string]*ServiceACL     `json:"service_acls"`
+
+	ServiceRateLimits map[string]*common.RateLimit `json:"service_rate_limits"`
+	ServiceConnLimits map[string]*common.ConnLimit `json:"service_conn_limits"`
+	MaxSessionConns   int                          `json:"max_session_conns"`
+
+	allowPorts []common.PortRange
+	portPool   []common.PortRange
+	mutex      sync.Mutex
+}
+
+func NewServerConfig() *BeanServerConfig {
+	return &BeanServerConfig{
+		BindAddr:         "0.0.0.0:8092",
+		ProxyBindAddr:    "0.0.0.0",
+		AllowPorts:       "1-65535",
+		HeartbeatTimeout: 60,
+		ResumeTimeout:    60,
+		LogLevel:         "info",
+		BindPolicy:       BindPolicyAllOrNothing,
+		UDPIdleTimeout:   60,
+		PSKRekeyBytes:    common.DefaultRekeyBytes,
+	}
+}
+
+func LoadServerConfig(path string, required bool) (*BeanServerConfig, error) {
+	config := NewServerConfig()
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && !required) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(content, config)
+		if err != nil {
+			return nil, errors.New("server config " + path + " format error: " + err.Error())
+		}
+	}
+	if config.TLSAutoCertDir == "" {
+		config.TLSAutoCertDir = filepath.Dir(path)
+	}
+	return config, nil
+}
+
+func (c *BeanServerConfig) ApplyEnv() error {
+	if v, ok := os.LookupEnv("BEAN_BIND_ADDR"); ok {
+		c.BindAddr = v
+	}
+	if v, ok := os.LookupEnv("BEAN_PROXY_BIND_ADDR"); ok {
+		c.ProxyBindAddr = v
+	}
+	if v, ok := os.LookupEnv("BEAN_ALLOW_PORTS"); ok {
+		c.AllowPorts = v
+	}
+	if v, ok := os.LookupEnv("BEAN_PORT_POOL"); ok {
+		c.PortPool = v
+	}
+	if v, ok := os.LookupEnv("BEAN_HEARTBEAT_TIMEOUT"); ok {
+		timeout, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("BEAN_HEARTBEAT_TIMEOUT must be a number of seconds")
+		}
+		c.HeartbeatTimeout = timeout
+	}
+	if v, ok := os.LookupEnv("BEAN_RESUME_TIMEOUT"); ok {
+		timeout, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("BEAN_RESUME_TIMEOUT must be a number of seconds")
+		}
+		c.ResumeTimeout = timeout
+	}
+	if v, ok := os.LookupEnv("BEAN_VHOST_HTTP_ADDR"); ok {
+		c.VhostHTTPAddr = v
+	}
+	if v, ok := os.LookupEnv("BEAN_VHOST_HTTPS_ADDR"); ok {
+		c.VhostHTTPSAddr = v
+	}
+	if v, ok := os.LookupEnv("BEAN_MAX_SESSION_CONNS"); ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.New("BEAN_MAX_SESSION_CONNS must be a number")
+		}
+		c.MaxSessionConns = limit
+	}
+	if v, ok := os.LookupEnv("BEAN_ADMIN_ADDR"); ok {
+		c.AdminAddr = v
+	}
+	if v, ok := os.LookupEnv("BEAN_ADMIN_TOKEN"); ok {
+		c.AdminToken = v
+	}
+	if v, ok := os.LookupEnv("BEAN_LOG_LEVEL"); ok {
+		c.LogLevel = v
+	}
+	if v, ok := os.LookupEnv("BEAN_BIND_POLICY"); ok {
+		c.BindPolicy = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TOKEN"); ok {
+		c.Token = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TOKEN_FILE"); ok {
+		c.TokenFile = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TLS_ENABLE"); ok {
+		enable, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.New("BEAN_TLS_ENABLE must be true or false")
+		}
+		c.TLSEnable = enable
+	}
+	if v, ok := os.LookupEnv("BEAN_TLS_CERT_FILE"); ok {
+		c.TLSCertFile = v
+	}
+	if v, ok := os.LookupEnv("BEAN_TLS_KEY_FILE"); ok {
+		c.TLSKeyFile = v
+	}
+	if v, ok := os.LookupEnv("BEAN_PSK"); ok {
+		c.PSK = v
+	}
+	if v, ok := os.LookupEnv("BEAN_PSK_REKEY_BYTES"); ok {
+		rekey, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.New("BEAN_PSK_REKEY_BYTES must be a number of bytes")
+		}
+		c.PSKRekeyBytes = rekey
+	}
+	return nil
+}
+
+func (c *BeanServerConfig) Validate() error {
+	if c.BindAddr == "" {
+		return errors.New("bind_addr is empty")
+	}
+	ranges, err := common.ParsePortRanges(c.AllowPorts)
+	if err != nil {
+		return errors.New("allow_ports: " + err.Error())
+	}
+	c.allowPorts = ranges
+	c.portPool, err = common.ParsePortRanges(c.PortPool)
+	if err != nil {
+		return errors.New("port_pool: " + err.Error())
+	}
+	if minTimeout := 3 * int(common.HeartbeatInterval/time.Second); c.HeartbeatTimeout < minTimeout {
+		return errors.New("heartbeat_timeout must be at least " + strconv.Itoa(minTimeout) + " seconds")
+	}
+	if _, err = handler.ParseLogLevel(c.LogLevel); err != nil {
+		return errors.New("log_level: " + err.Error())
+	}
+	if c.UDPIdleTimeout <= 0 {
+		return errors.New("udp_idle_timeout must be greater than 0")
+	}
+	if c.ResumeTimeout < 0 {
+		return errors.New("resume_timeout must not be negative")
+	}
+	if c.BindPolicy != BindPolicyAllOrNothing && c.BindPolicy != BindPolicyPartial {
+		return errors.New("bind_policy must be " + BindPolicyAllOrNothing + " or " + BindPolicyPartial)
+	}
+	if c.PSK != "" && len(c.PSK) < 16 {
+		return errors.New("psk must be at least 16 characters")
+	}
+	if c.PSKRekeyBytes <= 0 {
+		return errors.New("psk_rekey_bytes must be greater than 0")
+	}
+	if c.AdminAddr != "" && len(c.AdminToken) < 16 {
+		return errors.New("admin_addr requires an admin_token of at least 16 characters")
+	}
+	if c.TLSClientCAFile != "" && !c.TLSEnable {
+		return errors.New("tls_client_ca_file requires tls_enable")
+	}
+	for name, acl := range c.ServiceACLs {
+		if acl == nil {
+			continue
+		}
+		if _, err = common.ParseIPFilter(acl.AllowIPs, acl.DenyIPs); err != nil {
+			return errors.New("service_acls." + name + ": " + err.Error())
+		}
+	}
+	for name, limit := range c.ServiceRateLimits {
+		if err = limit.Validate(); err != nil {
+			return errors.New("service_rate_limits." + name + ": " + err.Error())
+		}
+	}
+	if c.MaxSessionConns < 0 {
+		return errors.New("max_session_conns must not be negative")
+	}
+	for name, limit := range c.ServiceConnLimits {
+		if err = limit.Validate(); err != nil {
+			return errors.New("service_conn_limits." + name + ": " + err.Error())
+		}
+	}
+	for name, identity := range c.ClientIdentities {
+		if identity == nil {
+			return errors.New("client_identities." + name + " is empty")
+		}
+		identity.Name = name
+		identity.ports, err = common.ParsePortRanges(identity.Ports)
+		if err != nil {
+			return errors.New("client_identities." + name + ".ports: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (c *BeanServerConfig) PortAllowed(port int) bool {
+	for _, r := range c.allowPorts {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
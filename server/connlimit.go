@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bean/common"
+	"errors"
+	"sync"
+	"time"
+)
+
+const connQueueSize = 128
+
+var (
+	errConnLimit  = errors.New("connection limit reached")
+	errConnQueued = errors.New("connection queued")
+	errQueueFull  = errors.New("connection queue full")
+)
+
+func (c *BeanServerConfig) serviceConnLimit(name string) *common.ConnLimit {
+	if limit, ok := c.ServiceConnLimits[name]; ok && limit != nil {
+		return limit
+	}
+	return c.ServiceConnLimits["*"]
+}
+
+func sessionConnLimit(c *BeanServerConfig) *common.ConnLimit {
+	if c.MaxSessionConns <= 0 {
+		return nil
+	}
+	return &common.ConnLimit{MaxConns: c.MaxSessionConns}
+}
+
+type connGate struct {
+	limit   *common.ConnLimit
+	total   int
+	perIP   map[string]int
+	waiting int
+	notify  chan struct{}
+	mutex   sync.Mutex
+}
+
+func newConnGate(limit *common.ConnLimit) *connGate {
+	return &connGate{
+		limit:  limit,
+		perIP:  make(map[string]int),
+		notify: make(chan struct{}),
+	}
+}
+
+func (g *connGate) setLimit(limit *common.ConnLimit) {
+	g.mutex.Lock()
+	g.limit = limit
+	g.wake()
+	g.mutex.Unlock()
+}
+
+func (g *connGate) getLimit() *common.ConnLimit {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.limit
+}
+
+func (g *connGate) wake() {
+	close(g.notify)
+	g.notify = make(chan struct{})
+}
+
+func (g *connGate) changed() <-chan struct{} {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.notify
+}
+
+func (g *connGate) take(ip string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.limit != nil {
+		if g.limit.MaxConns > 0 && g.total >= g.limit.MaxConns {
+			return false
+		}
+		if g.limit.MaxConnsPerIP > 0 && g.perIP[ip] >= g.limit.MaxConnsPerIP {
+			return false
+		}
+	}
+	g.total++
+	g.perIP[ip]++
+	return true
+}
+
+func (g *connGate) release(ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.total--
+	if g.perIP[ip]--; g.perIP[ip] <= 0 {
+		delete(g.perIP, ip)
+	}
+	g.wake()
+}
+
+func (g *connGate) enqueue() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.waiting >= connQueueSize {
+		return false
+	}
+	g.waiting++
+	return true
+}
+
+func (g *connGate) dequeue() {
+	g.mutex.Lock()
+	g.waiting--
+	g.mutex.Unlock()
+}
+
+func (g *connGate) count() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.total
+}
+
+type connTicket struct {
+	ip    string
+	gates []*connGate
+	once  sync.Once
+}
+
+func tryTicket(ip string, gates ...*connGate) (*connTicket, bool) {
+	for i, g := range gates {
+		if !g.take(ip) {
+			for _, taken := range gates[:i] {
+				taken.release(ip)
+			}
+			return nil, false
+		}
+	}
+	return &connTicket{ip: ip, gates: gates}, true
+}
+
+func (t *connTicket) Release() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		for _, g := range t.gates {
+			g.release(t.ip)
+		}
+	})
+}
+
+func (l *ListenerWrapper) admit(ip string) (*connTicket, error) {
+	ticket, ok := tryTicket(ip, l.owner().Gate, l.Gate)
+	if ok {
+		return ticket, nil
+	}
+	if !l.Gate.getLimit().Queued() {
+		return nil, errConnLimit
+	}
+	if !l.Gate.enqueue() {
+		return nil, errQueueFull
+	}
+	return nil, errConnQueued
+}
+
+func (l *ListenerWrapper) admitQueued(ip string) (*connTicket, error) {
+	defer l.Gate.dequeue()
+	timer := time.NewTimer(time.Duration(l.Gate.getLimit().Timeout()) * time.Second)
+	defer timer.Stop()
+	for {
+		session := l.owner().Gate
+		serviceChanged, sessionChanged := l.Gate.changed(), session.changed()
+		if ticket, ok := tryTicket(ip, session, l.Gate); ok {
+			return ticket, nil
+		}
+		select {
+		case <-serviceChanged:
+		case <-sessionChanged:
+		case <-timer.C:
+			return nil, errConnLimit
+		}
+	}
+}
@@ -8,57 +8,382 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 )
 
 type ListenerWrapper struct {
-	ClientMap map[string]*ClientConn
-	Listener  net.Listener
+	Name        string
+	ClientMap   map[string]*ClientConn
+	Listener    net.Listener
+	Owner       *BeanServer
+	Protocol    string
+	Compression string
+	Filter      *common.IPFilter
+	RateLimit   *common.RateLimit
+	Shaper      *common.Shaper
+	ConnLimit   *common.ConnLimit
+	Gate        *connGate
+	Traffic     *Traffic
+	Stats       *common.CompressionStats
+	Mutex       sync.Mutex
+}
+
+func (l *ListenerWrapper) filter() *common.IPFilter {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return l.Filter
+}
+
+func (l *ListenerWrapper) compression() string {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return l.Compression
+}
+
+func (l *ListenerWrapper) owner() *BeanServer {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return l.Owner
+}
+
+func (l *ListenerWrapper) closeClientConns() {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	for id, m := range l.ClientMap {
+		m.Abort()
+		delete(l.ClientMap, id)
+	}
+}
+
+func (l *ListenerWrapper) removeClientConn(id string) (*ClientConn, bool) {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	clientConn, ok := l.ClientMap[id]
+	if ok {
+		delete(l.ClientMap, id)
+	}
+	return clientConn, ok
+}
+
+func (l *ListenerWrapper) AcceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if nil != err {
+			fmt.Printf("l.Listener.Accept err %v: \r\n", err)
+			return
+		}
+		ip := common.AddrIP(conn.RemoteAddr())
+		if !l.filter().Allowed(ip) {
+			handler.Warnf("service %s rejected connection from %s by ip filter", l.Name, conn.RemoteAddr().String())
+			rejectConn(conn)
+			continue
+		}
+		ticket, err := l.admit(ip.String())
+		if err == errConnQueued {
+			go l.openQueued(conn, ip.String())
+			continue
+		}
+		if err != nil {
+			handler.Warnf("service %s rejected connection from %s: %v", l.Name, conn.RemoteAddr().String(), err)
+			rejectConn(conn)
+			continue
+		}
+		l.open(conn, ticket)
+	}
+}
+
+func rejectConn(conn net.Conn) {
+	if c, ok := conn.(*udpConn); ok {
+		c.Reject()
+		return
+	}
+	conn.Close()
+}
+
+func (l *ListenerWrapper) openQueued(conn net.Conn, ip string) {
+	ticket, err := l.admitQueued(ip)
+	if err != nil {
+		handler.Warnf("service %s rejected queued connection from %s: %v", l.Name, conn.RemoteAddr().String(), err)
+		rejectConn(conn)
+		return
+	}
+	l.open(conn, ticket)
+}
+
+func (l *ListenerWrapper) open(conn net.Conn, ticket *connTicket) {
+	s := l.owner()
+	id := handler.RandStringRunes(12)
+	clientConn := NewClientConn(id, conn, l, s.Outbox)
+	clientConn.Ticket = ticket
+	if !s.addClientConn(l.Name, clientConn) {
+		clientConn.Abort()
+		return
+	}
+	connReq := &common.ConnectRequest{
+		Id:   id,
+		Name: l.Name,
+		Ip:   conn.RemoteAddr().String(),
+		Dst:  conn.LocalAddr().String(),
+	}
+	if s.HasCapability(common.CapBinaryFrames) {
+		connReq.Sid = clientConn.Sid
+	}
+	if err := s.Outbox.Write(connReq); err != nil {
+		l.removeClientConn(id)
+		clientConn.Abort()
+	}
 }
 
 type ClientConn struct {
-	Id     string
-	Conn   net.Conn
-	ReadCh chan []byte
+	Id      string
+	Sid     uint32
+	Conn    net.Conn
+	Wrapper *ListenerWrapper
+	Window  *common.SendWindow
+	Writer  *common.StreamWriter
+	Shape   *common.ConnShaper
+	Ticket  *connTicket
+	Traffic *Traffic
+	Created time.Time
+}
+
+func NewClientConn(id string, conn net.Conn, wrapper *ListenerWrapper, outbox *common.Outbox) *ClientConn {
+	traffic := &Traffic{}
+	conn = &meteredConn{Conn: conn, traffic: []*Traffic{traffic, wrapper.Traffic}}
+	clientConn := &ClientConn{
+		Id:      id,
+		Conn:    conn,
+		Traffic: traffic,
+		Created: time.Now(),
+		Wrapper: wrapper,
+		Window:  common.NewSendWindow(common.DefaultStreamWindow),
+		Shape:   wrapper.Shaper.Open(),
+	}
+	clientConn.Sid = streams.Add(clientConn)
+	clientConn.Writer = common.NewStreamWriter(conn, common.DefaultStreamWindow, func(n int) {
+		outbox.Write(&common.WindowUpdate{Id: id, Name: wrapper.Name, Credit: n})
+	}, func(err error) {
+		fmt.Printf("err %v: \r\n", err)
+		wrapper.removeClientConn(id)
+		clientConn.Window.Close()
+		outbox.Write(&common.CloseRequest{Id: id, Name: wrapper.Name})
+	})
+	clientConn.Writer.Limit(clientConn.Shape.UploadBuckets())
+	return clientConn
+}
+
+func (c *ClientConn) Abort() {
+	streams.Remove(c.Sid)
+	c.Ticket.Release()
+	c.Shape.Release()
+	c.Window.Close()
+	c.Writer.Abort()
+}
+
+func (c *ClientConn) Close() {
+	streams.Remove(c.Sid)
+	c.Ticket.Release()
+	c.Shape.Release()
+	c.Window.Close()
+	c.Writer.Close()
 }
 
 type BeanServer struct {
 	Id         string
+	Key        string
 	Conn       net.Conn
 	Listener   map[string]*ListenerWrapper
 	ReadCh     chan common.Message
 	SendCh     chan common.Message
+	CloseCh    chan struct{}
 	ServiceReq *common.ServiceRequest
+	Config     *BeanServerConfig
+	Identity   *ClientIdentity
+	Outbox     *common.Outbox
+	Session    string
+	HelloReq   *common.HelloRequest
+	Caps       []string
+	Gate       *connGate
+	Connected  time.Time
+	handed     map[string]*ListenerWrapper
+	resumed    bool
+	peerSeq    uint64
+	takenOver  bool
+	detached   bool
+	LastActive time.Time
 	Closed     bool
 	Mutex      sync.Mutex
 }
 
+func (s *BeanServer) HasCapability(c string) bool {
+	return common.HasCapability(s.Caps, c)
+}
+
 func (s *BeanServer) Close() {
+	timeout := time.Duration(s.Config.ResumeTimeout) * time.Second
+	if timeout <= 0 || s.Session == "" {
+		s.Shutdown()
+		return
+	}
 	s.Mutex.Lock()
-	if !s.Closed {
-		close(s.ReadCh)
-		close(s.SendCh)
-		s.Closed = true
+	if s.Closed || s.detached {
+		s.Mutex.Unlock()
+		return
 	}
+	s.detached = true
+	close(s.CloseCh)
 	s.Mutex.Unlock()
-	for _, v := range s.Listener {
-		for _, m := range v.ClientMap {
-			if m.Conn != nil {
-				m.Conn.Close()
-			}
+	if s.Outbox != nil {
+		s.Outbox.Detach(s.Conn)
+	}
+	if s.Conn != nil {
+		s.Conn.Close()
+	}
+	handler.Infof("client %s connection lost, keep session for %v", s.Id, timeout)
+	time.AfterFunc(timeout, func() {
+		s.Mutex.Lock()
+		takenOver := s.takenOver
+		s.Mutex.Unlock()
+		if !takenOver {
+			s.Shutdown()
 		}
+	})
+}
+
+func (s *BeanServer) Shutdown() {
+	s.Mutex.Lock()
+	if s.Closed {
+		s.Mutex.Unlock()
+		return
+	}
+	s.Closed = true
+	if !s.detached {
+		close(s.CloseCh)
+	}
+	for _, v := range s.Listener {
+		v.closeClientConns()
 		if v.Listener != nil {
 			v.Listener.Close()
 		}
+		if v.compression() != common.CompressionNone {
+			handler.Infof("client %s service %s compression %s", s.Id, v.Name, v.Stats.String())
+		}
+	}
+	released := len(s.Listener)
+	outbox := s.Outbox
+	s.Mutex.Unlock()
+	sessions.Remove(s)
+	if outbox != nil {
+		outbox.Close()
 	}
 	if s.Conn != nil {
 		s.Conn.Close()
 	}
+	handler.Infof("client %s session closed, %d listeners released", s.Id, released)
+}
+
+func (s *BeanServer) Done() <-chan struct{} {
+	return s.CloseCh
+}
+
+func (s *BeanServer) Send(m common.Message) bool {
+	select {
+	case s.SendCh <- m:
+		return true
+	case <-s.CloseCh:
+		return false
+	}
+}
+
+func (s *BeanServer) Touch() {
+	s.Mutex.Lock()
+	s.LastActive = time.Now()
+	s.Mutex.Unlock()
+}
+
+func (s *BeanServer) KeepAlive() {
+	timeout := time.Duration(s.Config.HeartbeatTimeout) * time.Second
+	ticker := time.NewTicker(timeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.CloseCh:
+			return
+		case <-ticker.C:
+			s.Mutex.Lock()
+			idle := time.Since(s.LastActive)
+			s.Mutex.Unlock()
+			if idle > timeout {
+				handler.Warnf("client %s sent no heartbeat for %v, closing session", s.Id, idle)
+				s.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *BeanServer) getListener(name string) (*ListenerWrapper, bool) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	wrapper, ok := s.Listener[name]
+	return wrapper, ok && !s.Closed
+}
+
+func (s *BeanServer) getClientConn(name string, id string) (*ClientConn, bool) {
+	wrapper, ok := s.getListener(name)
+	if !ok {
+		return nil, false
+	}
+	wrapper.Mutex.Lock()
+	defer wrapper.Mutex.Unlock()
+	clientConn, ok := wrapper.ClientMap[id]
+	return clientConn, ok
+}
+
+func (s *BeanServer) getStream(sid uint32) (*ClientConn, bool) {
+	clientConn, ok := streams.Get(sid)
+	if !ok || clientConn.Wrapper.owner() != s {
+		return nil, false
+	}
+	return clientConn, true
+}
+
+func (s *BeanServer) addClientConn(name string, clientConn *ClientConn) bool {
+	wrapper, ok := s.getListener(name)
+	if !ok {
+		return false
+	}
+	wrapper.Mutex.Lock()
+	defer wrapper.Mutex.Unlock()
+	if wrapper.Owner != s {
+		return false
+	}
+	wrapper.ClientMap[clientConn.Id] = clientConn
+	return true
+}
+
+func (s *BeanServer) removeClientConn(name string, id string) (*ClientConn, bool) {
+	wrapper, ok := s.getListener(name)
+	if !ok {
+		return nil, false
+	}
+	wrapper.Mutex.Lock()
+	defer wrapper.Mutex.Unlock()
+	clientConn, ok := wrapper.ClientMap[id]
+	if ok {
+		delete(wrapper.ClientMap, id)
+	}
+	return clientConn, ok
 }
 
 func (s *BeanServer) WorkConn() net.Conn {
 	return s.Conn
 }
 
+func (s *BeanServer) Sender() *common.Outbox {
+	return s.Outbox
+}
+
 func (s *BeanServer) ReaderCh() chan common.Message {
 	return s.ReadCh
 }
@@ -67,50 +392,255 @@ func (s *BeanServer) SenderCh() chan common.Message {
 	return s.SendCh
 }
 
+func (s *BeanServer) bindService(item common.ServiceBody) (net.Listener, common.ServiceStatus) {
+	status := common.ServiceStatus{
+		Name:       item.Name,
+		Protocol:   common.NormalizeProtocol(item.Protocol),
+		RemotePort: item.RemotePort.Start,
+	}
+	if !common.ValidProtocol(item.Protocol) {
+		status.Reason = common.ReasonBindFailed
+		status.Message = "不支持的协议: " + item.Protocol
+		return nil, status
+	}
+	if s.Identity != nil && !s.Identity.AllowService(item.Name) {
+		handler.Warnf("client %s is not allowed to register service %s", s.Id, item.Name)
+		status.Reason = common.ReasonForbidden
+		status.Message = "证书无权注册服务: " + item.Name
+		return nil, status
+	}
+	if _, exists := s.Listener[item.Name]; exists {
+		status.Reason = common.ReasonBindFailed
+		status.Message = "服务名重复: " + item.Name
+		return nil, status
+	}
+	if common.IsVhostProtocol(status.Protocol) {
+		return s.bindVhost(item, status)
+	}
+	listen, err := s.listenRemotePort(status.Protocol, item.RemotePort)
+	if err == errNoAllowedPort {
+		handler.Warnf("client %s requested port %s which is not allowed", s.Id, item.RemotePort.String())
+		status.Reason = common.ReasonBindFailed
+		status.Message = "端口不允许: " + item.RemotePort.String()
+		return nil, status
+	}
+	if nil != err {
+		fmt.Printf("err %v: \r\n", err)
+		status.Reason = common.ReasonBindFailed
+		status.Message = "端口被占用: " + err.Error()
+		return nil, status
+	}
+	status.Success = true
+	status.RemotePort = addrPort(listen.Addr())
+	status.BindAddr = listen.Addr().String()
+	status.Compression = s.serviceCompression(item)
+	return listen, status
+}
+
+func (s *BeanServer) reuseListener(item common.ServiceBody) (*ListenerWrapper, common.ServiceStatus, bool) {
+	wrapper, ok := s.handed[item.Name]
+	if !ok {
+		return nil, common.ServiceStatus{}, false
+	}
+	delete(s.handed, item.Name)
+	port := addrPort(wrapper.Listener.Addr())
+	reusable := wrapper.Protocol == common.NormalizeProtocol(item.Protocol)
+	if vhost, ok := wrapper.Listener.(*vhostListener); ok {
+		reusable = reusable && sameDomains(vhost.Domains(), item.Domains)
+	} else {
+		reusable = reusable && (item.RemotePort.IsAny() || item.RemotePort.Contains(port))
+	}
+	if !reusable {
+		wrapper.Listener.Close()
+		return nil, common.ServiceStatus{}, false
+	}
+	status := common.ServiceStatus{
+		Name:        item.Name,
+		Protocol:    wrapper.Protocol,
+		RemotePort:  port,
+		BindAddr:    wrapper.Listener.Addr().String(),
+		Success:     true,
+		Compression: s.serviceCompression(item),
+	}
+	if vhost, ok := wrapper.Listener.(*vhostListener); ok {
+		status.Domains = vhost.Domains()
+	}
+	wrapper.Mutex.Lock()
+	wrapper.Compression = status.Compression
+	wrapper.Mutex.Unlock()
+	return wrapper, status, true
+}
+
+func (s *BeanServer) bindVhost(item common.ServiceBody, status common.ServiceStatus) (net.Listener, common.ServiceStatus) {
+	router := httpVhosts
+	if status.Protocol == common.ProtocolHTTPS {
+		router = httpsVhosts
+	}
+	if router == nil {
+		status.Reason = common.ReasonBindFailed
+		status.Message = "服务器未开启 " + status.Protocol + " 虚拟主机"
+		return nil, status
+	}
+	listen, err := router.Register(item.Domains)
+	if err != nil {
+		handler.Warnf("client %s service %s domains %v: %v", s.Id, item.Name, item.Domains, err)
+		status.Reason = common.ReasonBindFailed
+		status.Message = "域名注册失败: " + err.Error()
+		return nil, status
+	}
+	status.Success = true
+	status.RemotePort = addrPort(listen.Addr())
+	status.BindAddr = listen.Addr().String()
+	status.Domains = listen.Domains()
+	status.Compression = s.serviceCompression(item)
+	return listen, status
+}
+
+func sameDomains(registered []string, requested []string) bool {
+	if len(registered) != len(requested) {
+		return false
+	}
+	for i, domain := range requested {
+		if registered[i] != normalizeHost(domain) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *BeanServer) serviceCompression(item common.ServiceBody) string {
+	compression := common.NormalizeCompression(item.Compression)
+	if !s.HasCapability(common.CapCompression) || !common.ValidCompression(compression) {
+		return common.CompressionNone
+	}
+	return compression
+}
+
 func (s *BeanServer) ProcessSvrRequest() {
 	serviceRequest := s.ServiceReq
 	resp := &common.ServiceResponse{
-		Success: true,
-		Id:      serviceRequest.Id,
-		Message: "服务启动成功.",
+		Success:  true,
+		Id:       serviceRequest.Id,
+		Message:  "服务启动成功.",
+		Services: make([]common.ServiceStatus, 0, len(serviceRequest.ServiceList)),
+	}
+	failed := 0
+	fresh := make([]*ListenerWrapper, 0)
+	s.Mutex.Lock()
+	if s.Closed {
+		s.Mutex.Unlock()
+		return
 	}
 	for _, item := range serviceRequest.ServiceList {
-		listen, err := net.Listen("tcp", "0.0.0.0:"+strconv.Itoa(item.RemotePort))
-		if nil != err {
-			fmt.Printf("err %v: \r\n", err)
-			resp.Message = "服务启动失败，端口被占用."
+		filter, err := s.serviceFilter(item)
+		if err != nil {
+			status := common.ServiceStatus{
+				Name:       item.Name,
+				Protocol:   common.NormalizeProtocol(item.Protocol),
+				RemotePort: item.RemotePort.Start,
+				Reason:     common.ReasonBindFailed,
+				Message:    "IP 过滤规则无效: " + err.Error(),
+			}
+			resp.Services = append(resp.Services, status)
+			handler.Warnf("client %s service %s open failed: %s", s.Id, item.Name, status.Message)
+			if failed == 0 {
+				resp.Reason = status.Reason
+			}
+			failed++
+			continue
+		}
+		limit := s.serviceRateLimit(item.Name, item.RateLimit)
+		connLimit := item.ConnLimit.Cap(s.Config.serviceConnLimit(item.Name))
+		if wrapper, status, ok := s.reuseListener(item); ok {
+			wrapper.Mutex.Lock()
+			wrapper.Filter = filter
+			wrapper.ConnLimit = item.ConnLimit
+			wrapper.Mutex.Unlock()
+			wrapper.setRateLimit(item.RateLimit, limit)
+			wrapper.Gate.setLimit(connLimit)
+			status.RateLimit = limit
+			status.ConnLimit = connLimit
+			resp.Services = append(resp.Services, status)
+			s.Listener[item.Name] = wrapper
+			handler.Infof("client %s keeps listening on %s", s.Id, status.BindAddr)
+			continue
+		}
+		listen, status := s.bindService(item)
+		if status.Success {
+			status.RateLimit = limit
+			status.ConnLimit = connLimit
+		}
+		resp.Services = append(resp.Services, status)
+		if !status.Success {
+			handler.Warnf("client %s service %s open failed: %s", s.Id, item.Name, status.Message)
+			if failed == 0 {
+				resp.Reason = status.Reason
+			}
+			failed++
+			continue
+		}
+		wrapper := &ListenerWrapper{
+			Name:        item.Name,
+			Listener:    listen,
+			ClientMap:   make(map[string]*ClientConn),
+			Owner:       s,
+			Protocol:    status.Protocol,
+			Compression: status.Compression,
+			Filter:      filter,
+			RateLimit:   item.RateLimit,
+			Shaper:      common.NewShaper(limit),
+			ConnLimit:   item.ConnLimit,
+			Gate:        newConnGate(connLimit),
+			Traffic:     &Traffic{},
+			Stats:       &common.CompressionStats{},
+		}
+		s.Listener[item.Name] = wrapper
+		fresh = append(fresh, wrapper)
+		handler.Infof("server start, listen to %s wait connect..", status.BindAddr)
+	}
+	for name, wrapper := range s.handed {
+		wrapper.closeClientConns()
+		wrapper.Listener.Close()
+		delete(s.handed, name)
+	}
+	if failed > 0 {
+		if s.Config.BindPolicy == BindPolicyPartial && failed < len(resp.Services) {
+			resp.Message = "部分服务启动成功."
+		} else {
 			resp.Success = false
-			break
-		}
-		s.Listener[item.Name] = &ListenerWrapper{
-			Listener:  listen,
-			ClientMap: make(map[string]*ClientConn),
-		}
-		fmt.Println("server start, listen to port " + strconv.Itoa(item.RemotePort) + " wait connect..")
-	}
-	s.SendCh <- resp
-	for n, l := range s.Listener {
-		go func(n string, l net.Listener) {
-			for {
-				conn, err := l.Accept()
-				if nil != err {
-					fmt.Printf("l.Listener.Accept err %v: \r\n", err)
-					return
-				}
-				id := handler.RandStringRunes(12)
-				s.Listener[n].ClientMap[id] = &ClientConn{
-					Id:     id,
-					Conn:   conn,
-					ReadCh: make(chan []byte, 100),
-				}
-				connReq := &common.ConnectRequest{
-					Id:   id,
-					Name: n,
-					Ip:   conn.RemoteAddr().String(),
+			resp.Message = "服务启动失败."
+			for name, l := range s.Listener {
+				l.closeClientConns()
+				l.Listener.Close()
+				delete(s.Listener, name)
+			}
+			fresh = fresh[:0]
+			for i := range resp.Services {
+				if resp.Services[i].Success {
+					resp.Services[i].Success = false
+					resp.Services[i].BindAddr = ""
+					resp.Services[i].Reason = common.ReasonRolledBack
+					resp.Services[i].Message = "其他服务启动失败，已回滚."
 				}
-				s.SendCh <- connReq
 			}
-		}(n, l.Listener)
+		}
+	}
+	resp.Session = s.Session
+	s.Mutex.Unlock()
+	if s.resumed {
+		resp.Resumed = true
+		resp.RecvSeq = s.Outbox.RecvSeq()
+		if err := s.Outbox.Resume(s.Conn, s.peerSeq, resp); err != nil {
+			handler.Warnf("client %s session resume failed: %v", s.Id, err)
+			s.Close()
+			return
+		}
+		handler.Infof("client %s session resumed", s.Id)
+	} else {
+		s.Send(resp)
+	}
+	for _, wrapper := range fresh {
+		go wrapper.AcceptLoop()
 	}
 }
 
@@ -119,48 +649,70 @@ func (s *BeanServer) OpenSvr() {
 		s.Close()
 	}()
 	for {
-		message, ok := <-s.ReadCh
-		if !ok {
+		var message common.Message
+		select {
+		case message = <-s.ReadCh:
+		case <-s.CloseCh:
 			fmt.Printf("client id = %s \r\n", s.Id)
 			return
 		}
+		accept, ack := s.Outbox.Receive(message)
+		if ack != nil {
+			s.Send(ack)
+		}
+		if !accept {
+			continue
+		}
 		switch v := message.(type) {
+		case *common.AckRequest:
+			s.Outbox.Ack(v.Seq)
 		case *common.ConnectResponse:
 			go ReadClientMessage(s, v)
 		case *common.CloseRequest:
-			clientConns, okConn := s.Listener[v.Name]
-			if okConn {
-				workConn, ok := clientConns.ClientMap[v.Id]
-				if ok {
-					s.Mutex.Lock()
-					delete(clientConns.ClientMap, v.Id)
-					s.Mutex.Unlock()
-					workConn.Conn.Close()
-				}
+			workConn, ok := s.removeClientConn(v.Name, v.Id)
+			if ok {
+				workConn.Close()
+			}
+		case *common.WindowUpdate:
+			workConn, ok := s.getClientConn(v.Name, v.Id)
+			if ok {
+				workConn.Window.Grant(v.Credit)
 			}
-
 		case *common.BinDataRequestWrapper:
-			clientConns := s.Listener[v.Name].ClientMap
-			workConn, ok := clientConns[v.Id]
+			if v.Sid != 0 {
+				workConn, ok := s.getStream(v.Sid)
+				if !ok {
+					continue
+				}
+				v.Id, v.Name = workConn.Id, workConn.Wrapper.Name
+			}
+			workConn, ok := s.getClientConn(v.Name, v.Id)
 			if !ok {
 				dtReq := &common.CloseRequest{
 					Id:   v.Id,
 					Name: v.Name,
 				}
-				s.SendCh <- dtReq
+				s.Send(dtReq)
 				continue
 			}
-			_, err := workConn.Conn.Write(v.Content)
+			workConn.Wrapper.Stats.Add(len(v.Content), v.Wire)
+			err := workConn.Writer.Push(v.Content)
 			if nil != err {
 				fmt.Printf("err %v: \r\n", err)
-				workConn.Conn.Close()
+				s.removeClientConn(v.Name, v.Id)
+				workConn.Abort()
+				s.Send(&common.CloseRequest{Id: v.Id, Name: v.Name})
 			}
+		case *common.RateLimitRequest:
+			s.updateRateLimit(v)
 		case *common.HearBeatRequest:
-			fmt.Printf("hear beat {%s} \r\n", s.Id)
+			handler.Debugf("hear beat {%s}", s.Id)
+			s.Touch()
 			hrResp := &common.HearBeatResponse{
 				Cid: s.Id,
 			}
-			s.SendCh <- hrResp
+			s.Send(hrResp)
+			s.Send(s.Outbox.AckMessage())
 		default:
 			fmt.Println(v)
 		}
@@ -169,34 +721,48 @@ func (s *BeanServer) OpenSvr() {
 }
 
 func ReadClientMessage(client *BeanServer, request *common.ConnectResponse) {
+	channel, ok := client.getClientConn(request.Name, request.Id)
+	if !ok {
+		fmt.Println("ReadClientMessage error , workConn not exists in map.")
+		dtReq := &common.CloseRequest{
+			Id:   request.Id,
+			Name: request.Name,
+		}
+		client.Outbox.Write(dtReq)
+		return
+	}
+	outbox := client.Outbox
 	defer func() {
 		dtReq := &common.CloseRequest{
 			Id:   request.Id,
 			Name: request.Name,
 		}
-		client.Mutex.Lock()
-		delete(client.Listener[request.Name].ClientMap, request.Id)
-		client.Mutex.Unlock()
-		messageType := common.ParseMessageType(dtReq)
-		if err := common.WriteMessageByType(client.Conn, int8(messageType), dtReq); err != nil {
-			fmt.Println("panic error server ReadClientMessage")
-			client.Close()
-			return
+		channel.Wrapper.removeClientConn(request.Id)
+		if err := outbox.Write(dtReq); err != nil {
+			handler.Debugf("stream %s close request dropped: %v", request.Id, err)
 		}
 	}()
-	channel, ok := client.Listener[request.Name].ClientMap[request.Id]
-	if !ok {
-		fmt.Println("ReadClientMessage error , workConn not exists in map.")
-		return
-	}
 	workConn := channel.Conn
-	defer workConn.Close()
+	defer channel.Close()
+	var sid uint32
+	if request.Sid == channel.Sid {
+		sid = channel.Sid
+	}
 	swr := &common.JoinWriter{
-		Sender: client.Conn,
-		Id:     request.Id,
-		Name:   request.Name,
+		Sender:   outbox,
+		Window:   channel.Window,
+		Id:       request.Id,
+		Sid:      sid,
+		Name:     request.Name,
+		Compress: channel.Wrapper.compression() == common.CompressionFlate,
+		Datagram: channel.Wrapper.Protocol == common.ProtocolUDP,
+		Stats:    channel.Wrapper.Stats,
+		Limiters: channel.Shape.DownloadBuckets(),
 	}
 	buf := make([]byte, 16*1024)
+	if swr.Datagram {
+		buf = make([]byte, maxDatagramSize)
+	}
 	n, err := io.CopyBuffer(swr, workConn, buf)
 	fmt.Println("swr n = " + strconv.Itoa(int(n)))
 	if nil != err {
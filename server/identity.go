@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bean/common"
+	"crypto/tls"
+	"errors"
+)
+
+type ClientIdentity struct {
+	Name     string   `json:"-"`
+	Services []string `json:"services"`
+	Ports    string   `json:"ports"`
+
+	ports []common.PortRange
+}
+
+func (i *ClientIdentity) AllowService(name string) bool {
+	for _, s := range i.Services {
+		if s == "*" || s == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ClientIdentity) AllowPort(port int) bool {
+	if i.Ports == "" {
+		return true
+	}
+	for _, r := range i.ports {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolveCertIdentity(config *BeanServerConfig, state tls.ConnectionState) (*ClientIdentity, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("client certificate missing")
+	}
+	name := state.PeerCertificates[0].Subject.CommonName
+	identity, ok := config.ClientIdentities[name]
+	if !ok {
+		return nil, errors.New("client certificate subject " + name + " is not allowed")
+	}
+	return identity, nil
+}
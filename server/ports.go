@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bean/common"
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+const maxPortAttempts = 200
+
+var errNoAllowedPort = errors.New("no allowed port")
+
+func (s *BeanServer) portAllowed(port int) bool {
+	if !s.Config.PortAllowed(port) {
+		return false
+	}
+	return s.Identity == nil || s.Identity.AllowPort(port)
+}
+
+func (s *BeanServer) listenPort(protocol string, port int) (net.Listener, error) {
+	addr := net.JoinHostPort(s.Config.ProxyBindAddr, strconv.Itoa(port))
+	if protocol == common.ProtocolUDP {
+		listen, err := listenUDP(addr, time.Duration(s.Config.UDPIdleTimeout)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return listen, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func addrPort(addr net.Addr) int {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.Port
+	case *net.UDPAddr:
+		return v.Port
+	}
+	return 0
+}
+
+func (s *BeanServer) listenRemotePort(protocol string, remotePort common.PortRange) (net.Listener, error) {
+	ranges := []common.PortRange{remotePort}
+	if remotePort.IsAny() {
+		ranges = s.Config.portPool
+	}
+	if remotePort.IsAny() && len(ranges) == 0 {
+		listen, err := s.listenPort(protocol, 0)
+		if err == nil && s.portAllowed(addrPort(listen.Addr())) {
+			return listen, nil
+		}
+		if listen != nil {
+			listen.Close()
+		}
+		ranges = s.Config.allowPorts
+	}
+	candidates := make([]int, 0)
+	for _, r := range ranges {
+		for port := r.Start; port <= r.End; port++ {
+			if s.portAllowed(port) {
+				candidates = append(candidates, port)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errNoAllowedPort
+	}
+	offset := 0
+	if !remotePort.IsSingle() {
+		offset = rand.Intn(len(candidates))
+	}
+	var lastErr error
+	for i := 0; i < len(candidates) && i < maxPortAttempts; i++ {
+		listen, err := s.listenPort(protocol, candidates[(offset+i)%len(candidates)])
+		if err == nil {
+			return listen, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
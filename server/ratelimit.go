@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bean/common"
+	"bean/handler"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func (c *BeanServerConfig) serviceRateLimit(name string) *common.RateLimit {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if limit, ok := c.ServiceRateLimits[name]; ok && limit != nil {
+		return limit
+	}
+	return c.ServiceRateLimits["*"]
+}
+
+func (c *BeanServerConfig) SetServiceRateLimits(limits map[string]*common.RateLimit) {
+	c.mutex.Lock()
+	c.ServiceRateLimits = limits
+	c.mutex.Unlock()
+}
+
+func (s *BeanServer) serviceRateLimit(name string, requested *common.RateLimit) *common.RateLimit {
+	return requested.Cap(s.Config.serviceRateLimit(name))
+}
+
+func (l *ListenerWrapper) setRateLimit(requested *common.RateLimit, limit *common.RateLimit) {
+	l.Mutex.Lock()
+	l.RateLimit = requested
+	l.Mutex.Unlock()
+	l.Shaper.SetLimit(limit)
+}
+
+func (l *ListenerWrapper) requestedRateLimit() *common.RateLimit {
+	l.Mutex.Lock()
+	defer l.Mutex.Unlock()
+	return l.RateLimit
+}
+
+func (s *BeanServer) updateRateLimit(req *common.RateLimitRequest) {
+	resp := &common.RateLimitResponse{Name: req.Name}
+	wrapper, ok := s.getListener(req.Name)
+	if !ok {
+		resp.Message = "服务不存在: " + req.Name
+		s.Send(resp)
+		return
+	}
+	if err := req.RateLimit.Validate(); err != nil {
+		resp.Message = "限速配置无效: " + err.Error()
+		resp.RateLimit = wrapper.Shaper.Limit()
+		s.Send(resp)
+		return
+	}
+	limit := s.serviceRateLimit(req.Name, req.RateLimit)
+	wrapper.setRateLimit(req.RateLimit, limit)
+	handler.Infof("client %s service %s rate limit set to %+v", s.Id, req.Name, *wrapper.Shaper.Limit())
+	resp.Success = true
+	resp.RateLimit = limit
+	s.Send(resp)
+}
+
+func (s *BeanServer) applyRateLimitPolicy() {
+	s.Mutex.Lock()
+	wrappers := make([]*ListenerWrapper, 0, len(s.Listener))
+	for _, wrapper := range s.Listener {
+		wrappers = append(wrappers, wrapper)
+	}
+	s.Mutex.Unlock()
+	for _, wrapper := range wrappers {
+		requested := wrapper.requestedRateLimit()
+		limit := s.serviceRateLimit(wrapper.Name, requested)
+		wrapper.setRateLimit(requested, limit)
+		if s.HasCapability(common.CapRateLimit) {
+			s.Send(&common.RateLimitResponse{Name: wrapper.Name, Success: true, RateLimit: limit})
+		}
+	}
+}
+
+func ReloadRateLimits(config *BeanServerConfig, limits map[string]*common.RateLimit) {
+	config.SetServiceRateLimits(limits)
+	list := sessions.List()
+	for _, s := range list {
+		s.applyRateLimitPolicy()
+	}
+	handler.Infof("service rate limits reloaded, %d sessions updated", len(list))
+}
+
+func WatchReload(path string, config *BeanServerConfig) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		fresh, err := LoadServerConfig(path, true)
+		if err == nil {
+			err = fresh.ApplyEnv()
+		}
+		if err == nil {
+			err = fresh.Validate()
+		}
+		if err != nil {
+			handler.Warnf("reload config %s failed: %v", path, err)
+			continue
+		}
+		ReloadRateLimits(config, fresh.ServiceRateLimits)
+	}
+}
@@ -2,50 +2,252 @@ package server
 
 import (
 	"bean/common"
+	"bean/handler"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"time"
 )
 
-func Run() {
-	listen, err := net.Listen("tcp", "0.0.0.0:8092")
+const (
+	handshakeTimeout     = 15 * time.Second
+	maxPendingHandshakes = 128
+)
+
+func Run(config *BeanServerConfig) error {
+	tokenStore, err := NewTokenStore(config)
 	if err != nil {
-		fmt.Printf("err %v: \r\n", err)
-		return
+		return errors.New("token store: " + err.Error())
+	}
+	if _, open := tokenStore.(*openTokenStore); open {
+		handler.Warnf("no token configured, any client may register services")
+	}
+	if config.VhostHTTPAddr != "" {
+		httpVhosts, err = startHTTPVhostRouter(config.VhostHTTPAddr)
+		if err != nil {
+			return errors.New("vhost http: " + err.Error())
+		}
+	}
+	if config.VhostHTTPSAddr != "" {
+		httpsVhosts, err = startHTTPSVhostRouter(config.VhostHTTPSAddr)
+		if err != nil {
+			return errors.New("vhost https: " + err.Error())
+		}
 	}
-	fmt.Println("server start, listen to port 8092 wait connect..")
+	if config.AdminAddr != "" {
+		if err = startAdmin(config); err != nil {
+			return errors.New("admin api: " + err.Error())
+		}
+	}
+	listen, err := net.Listen("tcp", config.BindAddr)
+	if err != nil {
+		return err
+	}
+	if config.TLSEnable {
+		tlsConfig, err := newServerTLSConfig(config)
+		if err != nil {
+			listen.Close()
+			return errors.New("tls config: " + err.Error())
+		}
+		listen = tls.NewListener(listen, tlsConfig)
+		handler.Infof("tls enabled on control listener")
+	}
+	handler.Infof("server start, listen to %s wait connect..", config.BindAddr)
 	defer listen.Close()
+	pending := make(chan struct{}, maxPendingHandshakes)
 	for {
 		conn, err := listen.Accept()
 		if nil != err {
-			fmt.Printf("err %v: \r\n", err)
+			return err
+		}
+		select {
+		case pending <- struct{}{}:
+			go func() {
+				acceptClient(conn, config, tokenStore)
+				<-pending
+			}()
+		default:
+			handler.Warnf("too many pending handshakes, connection from %s refused", conn.RemoteAddr().String())
+			conn.Close()
+		}
+	}
+}
+
+func acceptClient(conn net.Conn, config *BeanServerConfig, tokenStore TokenStore) {
+	server := &BeanServer{
+		Conn:     conn,
+		Config:   config,
+		Listener: make(map[string]*ListenerWrapper),
+		ReadCh:   make(chan common.Message, 100),
+		SendCh:   make(chan common.Message, 100),
+		CloseCh:  make(chan struct{}),
+		Gate:     newConnGate(sessionConnLimit(config)),
+	}
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			handler.Warnf("tls handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+			server.Close()
 			return
 		}
-		server := &BeanServer{
-			Conn:     conn,
-			Listener: make(map[string]*ListenerWrapper),
-			ReadCh:   make(chan common.Message, 100),
-			SendCh:   make(chan common.Message, 100),
+	}
+	if config.PSK != "" {
+		secure, err := common.ServerPSKHandshake(conn, config.PSK, config.PSKRekeyBytes)
+		if err == common.ErrPSKRequired {
+			handler.Warnf("client from %s did not use the pre-shared key, refused", conn.RemoteAddr().String())
+			resp := &common.HelloResponse{
+				Version: common.ProtocolVersion,
+				Build:   common.BuildVersion,
+				Reason:  common.ReasonIncompatible,
+				Message: "服务器要求预共享密钥加密，请配置 psk",
+			}
+			common.SendMessage(conn, resp)
+			server.Close()
+			return
 		}
-		rawMessage, err := common.ReadMessageWait(server.Conn)
-		if err != nil || int8(rawMessage.Type) != 1 {
-			fmt.Printf("client err or msg type wrong \r\n")
+		if err == common.ErrPSKMismatch {
+			handler.Warnf("client from %s used a different pre-shared key, refused", conn.RemoteAddr().String())
 			server.Close()
-			continue
+			return
 		}
-		var srReq common.ServiceRequest
-		err = json.Unmarshal(rawMessage.Body, &srReq)
-		if nil != err {
-			fmt.Printf("client json format error \r\n")
+		if err != nil {
+			handler.Warnf("psk handshake with %s failed: %v", conn.RemoteAddr().String(), err)
 			server.Close()
-			continue
+			return
 		}
-		server.ServiceReq = &srReq
-		server.Id = srReq.Id
+		server.Conn = secure
+	}
+	if !server.Hello() {
+		server.Close()
+		return
+	}
+	rawMessage, err := common.ReadMessageLimit(server.Conn, common.MaxHandshakeSize)
+	if err != nil || rawMessage.Type != common.TypeServiceRequest {
+		fmt.Printf("client err or msg type wrong \r\n")
+		server.Close()
+		return
+	}
+	var srReq common.ServiceRequest
+	err = json.Unmarshal(rawMessage.Body, &srReq)
+	if nil != err {
+		fmt.Printf("client json format error \r\n")
+		server.Close()
+		return
+	}
+	authErr := ""
+	if !tokenStore.Verify(srReq.User, srReq.Token) {
+		authErr = "认证失败，token 无效."
+	} else if tlsConn, ok := conn.(*tls.Conn); ok && config.TLSClientCAFile != "" {
+		identity, err := resolveCertIdentity(config, tlsConn.ConnectionState())
+		if err != nil {
+			authErr = "认证失败，" + err.Error()
+		}
+		server.Identity = identity
+	}
+	if authErr != "" {
+		handler.Warnf("client %s user %q from %s authentication failed: %s", srReq.Id, srReq.User, conn.RemoteAddr().String(), authErr)
+		resp := &common.ServiceResponse{
+			Id:      srReq.Id,
+			Success: false,
+			Message: authErr,
+			Reason:  common.ReasonAuthFailed,
+		}
+		common.SendMessage(server.Conn, resp)
+		server.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	server.Conn = &common.TimeoutConn{
+		Conn:        server.Conn,
+		ReadTimeout: time.Duration(config.HeartbeatTimeout) * time.Second,
+	}
+	server.LastActive = time.Now()
+	server.Connected = server.LastActive
+	server.ServiceReq = &srReq
+	server.Id = srReq.Id
+	if server.Identity != nil {
+		server.Id = server.Identity.Name
+		srReq.Id = server.Identity.Name
+	}
+	server.Key = sessionKey(server)
+	if remaining, refused := sessions.Refused(server.Key); refused {
+		handler.Warnf("client %s from %s was kicked recently, refused for another %v", server.Id, conn.RemoteAddr().String(), remaining.Round(time.Second))
+		resp := &common.ServiceResponse{
+			Id:         server.Id,
+			Success:    false,
+			Message:    "客户端已被管理员踢下线，请稍后再连接.",
+			Reason:     common.ReasonKicked,
+			RetryAfter: int(remaining/time.Second) + 1,
+		}
+		common.SendMessage(server.Conn, resp)
+		server.Close()
+		return
+	}
+	old, registered := sessions.Register(server)
+	if !registered {
+		handler.Warnf("client %s from %s did not prove ownership of the live session from %s, refused", server.Id, conn.RemoteAddr().String(), old.Conn.RemoteAddr().String())
+		resp := &common.ServiceResponse{
+			Id:         server.Id,
+			Success:    false,
+			Message:    "该客户端 ID 已在其他连接上登录.",
+			Reason:     common.ReasonInUse,
+			RetryAfter: config.HeartbeatTimeout,
+		}
+		common.SendMessage(server.Conn, resp)
+		server.Close()
+		return
+	}
+	if old != nil {
+		server.Takeover(old)
+	}
+	if server.Outbox == nil {
+		server.Outbox = common.NewOutbox(server.Conn, common.DefaultOutboxLimit)
+		if config.ResumeTimeout > 0 && server.HasCapability(common.CapResume) {
+			server.Mutex.Lock()
+			server.Session = handler.RandStringRunes(24)
+			server.Mutex.Unlock()
+		}
+	}
 
-		go server.ProcessSvrRequest()
-		go common.MessageReader(server)
-		go common.MessageWriter(server)
-		go server.OpenSvr()
+	go server.ProcessSvrRequest()
+	go common.MessageReader(server)
+	go common.MessageWriter(server)
+	go server.OpenSvr()
+	go server.KeepAlive()
+}
+
+func (s *BeanServer) Hello() bool {
+	rawMessage, err := common.ReadMessageLimit(s.Conn, common.MaxHandshakeSize)
+	if err != nil {
+		handler.Warnf("hello from %s failed: %v", s.Conn.RemoteAddr().String(), err)
+		return false
+	}
+	if rawMessage.Type == common.TypeServiceRequest {
+		handler.Warnf("client from %s speaks a legacy protocol without hello, refused", s.Conn.RemoteAddr().String())
+		resp := &common.ServiceResponse{
+			Success: false,
+			Message: "协议版本不兼容，请升级客户端",
+			Reason:  common.ReasonIncompatible,
+		}
+		common.SendMessage(s.Conn, resp)
+		return false
+	}
+	message, err := common.ParseMessage(rawMessage)
+	helloReq, ok := message.(*common.HelloRequest)
+	if err != nil || !ok {
+		handler.Warnf("client from %s sent message type %d instead of hello", s.Conn.RemoteAddr().String(), rawMessage.Type)
+		return false
+	}
+	helloResp := common.Negotiate(helloReq, s.Config.PSK != "")
+	common.SendMessage(s.Conn, helloResp)
+	if !helloResp.Success {
+		handler.Warnf("client from %s refused: %s", s.Conn.RemoteAddr().String(), helloResp.Message)
+		return false
 	}
+	s.HelloReq = helloReq
+	s.Caps = helloResp.Capabilities
+	handler.Infof("client from %s protocol %d build %s capabilities %v", s.Conn.RemoteAddr().String(), helloReq.Version, helloReq.Build, s.Caps)
+	return true
 }
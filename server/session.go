@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bean/common"
+	"bean/handler"
+	"sync"
+	"time"
+)
+
+type SessionManager struct {
+	sessions map[string]*BeanServer
+	kicked   map[string]time.Time
+	mutex    sync.Mutex
+}
+
+var sessions = NewSessionManager()
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: make(map[string]*BeanServer),
+		kicked:   make(map[string]time.Time),
+	}
+}
+
+func (m *SessionManager) Register(s *BeanServer) (*BeanServer, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	old := m.sessions[s.Key]
+	if old != nil && !s.owns(old) {
+		return old, false
+	}
+	m.sessions[s.Key] = s
+	return old, true
+}
+
+func (m *SessionManager) Remove(s *BeanServer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.sessions[s.Key] == s {
+		delete(m.sessions, s.Key)
+	}
+}
+
+func (m *SessionManager) Get(key string) (*BeanServer, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, ok := m.sessions[key]
+	return s, ok
+}
+
+func (m *SessionManager) Kick(s *BeanServer, refuse time.Duration) {
+	m.mutex.Lock()
+	m.kicked[s.Key] = time.Now().Add(refuse)
+	m.mutex.Unlock()
+	s.Shutdown()
+}
+
+func (m *SessionManager) Refused(key string) (time.Duration, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for k, until := range m.kicked {
+		if now.After(until) {
+			delete(m.kicked, k)
+		}
+	}
+	until, ok := m.kicked[key]
+	return until.Sub(now), ok
+}
+
+func (m *SessionManager) List() []*BeanServer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	list := make([]*BeanServer, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+func sessionKey(s *BeanServer) string {
+	if s.Identity != nil {
+		return "cert:" + s.Identity.Name
+	}
+	return s.ServiceReq.User + "/" + s.ServiceReq.Id
+}
+
+// owns reports whether s may take over the listeners of old: the client
+// authenticated with a certificate, presented the same client secret, or
+// resumed the old session.
+func (s *BeanServer) owns(old *BeanServer) bool {
+	if s.Identity != nil {
+		return true
+	}
+	if s.ServiceReq.Secret != "" && s.ServiceReq.Secret == old.ServiceReq.Secret {
+		return true
+	}
+	resume := s.ServiceReq.Resume
+	old.Mutex.Lock()
+	defer old.Mutex.Unlock()
+	return resume != nil && old.Session != "" && resume.Session == old.Session
+}
+
+func (s *BeanServer) Takeover(old *BeanServer) {
+	resume := s.ServiceReq.Resume
+	old.Mutex.Lock()
+	handed := old.Listener
+	old.Listener = make(map[string]*ListenerWrapper)
+	if resume != nil && s.HasCapability(common.CapResume) && old.Session != "" && resume.Session == old.Session && old.Outbox != nil {
+		s.Outbox = old.Outbox
+		s.Session = old.Session
+		s.resumed = true
+		s.peerSeq = resume.RecvSeq
+		s.Gate = old.Gate
+		old.Outbox = nil
+	}
+	old.takenOver = true
+	old.Mutex.Unlock()
+	if s.resumed {
+		s.Outbox.Detach(nil)
+	}
+	for _, wrapper := range handed {
+		if !s.resumed {
+			wrapper.closeClientConns()
+		}
+		wrapper.Mutex.Lock()
+		wrapper.Owner = s
+		wrapper.Mutex.Unlock()
+	}
+	s.Mutex.Lock()
+	s.handed = handed
+	s.Mutex.Unlock()
+	handler.Infof("client %s reconnected, took over %d listeners from the stale session", s.Id, len(handed))
+	old.Shutdown()
+}
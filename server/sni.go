@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	httpsVhosts *VhostRouter
+
+	errSNIFound = errors.New("sni found")
+)
+
+func startHTTPSVhostRouter(addr string) (*VhostRouter, error) {
+	return newVhostRouter("https", addr, sniffSNI, rejectTLS)
+}
+
+func sniffSNI(r *bufio.Reader) (string, error) {
+	var serverName string
+	err := tls.Server(&sniffConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSNIFound
+		},
+	}).Handshake()
+	if serverName == "" {
+		if err == nil || err == errSNIFound {
+			err = errVhostNoHostname
+		}
+		return "", err
+	}
+	return serverName, nil
+}
+
+func rejectTLS(conn net.Conn, err error) {
+	conn.Close()
+}
+
+type sniffConn struct {
+	r io.Reader
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *sniffConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+func (c *sniffConn) Close() error {
+	return nil
+}
+
+func (c *sniffConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (c *sniffConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (c *sniffConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sniffConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *sniffConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+type StreamTable struct {
+	streams map[uint32]*ClientConn
+	next    uint32
+	mutex   sync.Mutex
+}
+
+var streams = NewStreamTable()
+
+func NewStreamTable() *StreamTable {
+	return &StreamTable{
+		streams: make(map[uint32]*ClientConn),
+	}
+}
+
+func (t *StreamTable) Add(clientConn *ClientConn) uint32 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for {
+		t.next++
+		if t.next == 0 {
+			continue
+		}
+		if _, ok := t.streams[t.next]; !ok {
+			break
+		}
+	}
+	t.streams[t.next] = clientConn
+	return t.next
+}
+
+func (t *StreamTable) Get(sid uint32) (*ClientConn, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	clientConn, ok := t.streams[sid]
+	return clientConn, ok
+}
+
+func (t *StreamTable) Remove(sid uint32) {
+	t.mutex.Lock()
+	delete(t.streams, sid)
+	t.mutex.Unlock()
+}
+
+type Traffic struct {
+	In  int64
+	Out int64
+}
+
+func (t *Traffic) BytesIn() int64 {
+	return atomic.LoadInt64(&t.In)
+}
+
+func (t *Traffic) BytesOut() int64 {
+	return atomic.LoadInt64(&t.Out)
+}
+
+type meteredConn struct {
+	net.Conn
+	traffic []*Traffic
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	for _, t := range c.traffic {
+		atomic.AddInt64(&t.In, int64(n))
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	for _, t := range c.traffic {
+		atomic.AddInt64(&t.Out, int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bean/common"
+	"bean/handler"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+const (
+	autoCertFile = "auto_cert.pem"
+	autoKeyFile  = "auto_key.pem"
+)
+
+func loadAutoCert(dir string, hosts []string) (tls.Certificate, error) {
+	certFile := filepath.Join(dir, autoCertFile)
+	keyFile := filepath.Join(dir, autoKeyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		handler.Infof("loaded self-signed certificate %s, sha256 fingerprint %s", certFile, common.CertFingerprint(cert.Certificate[0]))
+		return cert, nil
+	}
+	if _, statErr := os.Stat(certFile); !os.IsNotExist(statErr) {
+		return tls.Certificate{}, errors.New("saved self-signed certificate " + certFile + ": " + err.Error())
+	}
+	cert, err = common.GenerateSelfSignedCert(hosts)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	handler.Infof("generated self-signed certificate, sha256 fingerprint %s", common.CertFingerprint(cert.Certificate[0]))
+	certPEM, keyPEM, err := common.EncodeKeyPairPEM(cert)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, keyPEM, 0600)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(certFile, certPEM, 0644)
+	}
+	if err != nil {
+		handler.Warnf("could not save self-signed certificate to %s, pinned clients will break after restart: %v", dir, err)
+	} else {
+		handler.Infof("saved self-signed certificate to %s", certFile)
+	}
+	return cert, nil
+}
+
+func newServerTLSConfig(config *BeanServerConfig) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		cert, err = tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if config.TLSAutoCert {
+		hosts := config.TLSAutoCertHosts
+		if len(hosts) == 0 {
+			host, _, _ := net.SplitHostPort(config.BindAddr)
+			hosts = []string{host}
+		}
+		cert, err = loadAutoCert(config.TLSAutoCertDir, hosts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, errors.New("tls_enable requires tls_cert_file/tls_key_file or tls_auto_cert")
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.TLSClientCAFile != "" {
+		pool, err := common.LoadCertPool(config.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
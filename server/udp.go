@@ -0,0 +1,235 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxDatagramSize = 64 * 1024
+	udpInboxSize    = 64
+	udpAcceptSize   = 64
+	udpDenySize     = 1024
+	udpDenyTimeout  = 10 * time.Second
+)
+
+var errListenerClosed = errors.New("udp listener closed")
+
+type udpListener struct {
+	conn        net.PacketConn
+	idleTimeout time.Duration
+	sessions    map[string]*udpConn
+	denied      map[string]time.Time
+	acceptCh    chan *udpConn
+	closeCh     chan struct{}
+	closed      bool
+	mutex       sync.Mutex
+}
+
+func listenUDP(addr string, idleTimeout time.Duration) (*udpListener, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		conn:        conn,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*udpConn),
+		denied:      make(map[string]time.Time),
+		acceptCh:    make(chan *udpConn, udpAcceptSize),
+		closeCh:     make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+func (l *udpListener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		l.deliver(addr, datagram)
+	}
+}
+
+func (l *udpListener) deliver(addr net.Addr, datagram []byte) {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return
+	}
+	key := addr.String()
+	if until, ok := l.denied[key]; ok {
+		if time.Now().Before(until) {
+			l.mutex.Unlock()
+			return
+		}
+		delete(l.denied, key)
+	}
+	c, ok := l.sessions[key]
+	if !ok {
+		c = &udpConn{
+			listener: l,
+			addr:     addr,
+			inbox:    make(chan []byte, udpInboxSize),
+			closeCh:  make(chan struct{}),
+		}
+		c.touch()
+		select {
+		case l.acceptCh <- c:
+			l.sessions[key] = c
+		default:
+			l.mutex.Unlock()
+			return
+		}
+	}
+	l.mutex.Unlock()
+	select {
+	case c.inbox <- datagram:
+	default:
+	}
+}
+
+func (l *udpListener) remove(c *udpConn) {
+	l.mutex.Lock()
+	if l.sessions[c.addr.String()] == c {
+		delete(l.sessions, c.addr.String())
+	}
+	l.mutex.Unlock()
+}
+
+func (l *udpListener) deny(addr net.Addr) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	if len(l.denied) >= udpDenySize {
+		for key, until := range l.denied {
+			if now.After(until) {
+				delete(l.denied, key)
+			}
+		}
+		if len(l.denied) >= udpDenySize {
+			return
+		}
+	}
+	l.denied[addr.String()] = now.Add(udpDenyTimeout)
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.acceptCh:
+		return c, nil
+	case <-l.closeCh:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *udpListener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.closeCh)
+	sessions := l.sessions
+	l.sessions = make(map[string]*udpConn)
+	l.mutex.Unlock()
+	for _, c := range sessions {
+		c.Close()
+	}
+	return l.conn.Close()
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type udpConn struct {
+	listener   *udpListener
+	addr       net.Addr
+	inbox      chan []byte
+	lastActive int64
+	closeCh    chan struct{}
+	closeOnce  sync.Once
+}
+
+func (c *udpConn) touch() {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+}
+
+func (c *udpConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	for {
+		wait := c.listener.idleTimeout - c.idle()
+		if wait <= 0 {
+			return 0, io.EOF
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case datagram := <-c.inbox:
+			timer.Stop()
+			c.touch()
+			return copy(p, datagram), nil
+		case <-c.closeCh:
+			timer.Stop()
+			return 0, io.EOF
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closeCh:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	c.touch()
+	return c.listener.conn.WriteTo(p, c.addr)
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeCh)
+		c.listener.remove(c)
+	})
+	return nil
+}
+
+func (c *udpConn) Reject() {
+	c.listener.deny(c.addr)
+	c.Close()
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.listener.conn.LocalAddr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
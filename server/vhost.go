@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bean/handler"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vhostSniffTimeout = 10 * time.Second
+	vhostAcceptSize   = 64
+)
+
+var (
+	errDomainConflict  = errors.New("domain already registered")
+	errNoDomain        = errors.New("no domains")
+	errVhostNoHostname = errors.New("no host name in request")
+)
+
+type hostSniffer func(r *bufio.Reader) (string, error)
+
+type VhostRouter struct {
+	Name     string
+	listener net.Listener
+	sniff    hostSniffer
+	reject   func(conn net.Conn, err error)
+	routes   map[string]*vhostListener
+	mutex    sync.Mutex
+}
+
+var httpVhosts *VhostRouter
+
+func newVhostRouter(name string, addr string, sniff hostSniffer, reject func(conn net.Conn, err error)) (*VhostRouter, error) {
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &VhostRouter{
+		Name:     name,
+		listener: listen,
+		sniff:    sniff,
+		reject:   reject,
+		routes:   make(map[string]*vhostListener),
+	}
+	go r.serve()
+	handler.Infof("%s vhost router listen to %s", name, listen.Addr().String())
+	return r, nil
+}
+
+func startHTTPVhostRouter(addr string) (*VhostRouter, error) {
+	return newVhostRouter("http", addr, sniffHTTPHost, rejectHTTP)
+}
+
+func (r *VhostRouter) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			handler.Warnf("%s vhost router stopped: %v", r.Name, err)
+			return
+		}
+		go r.route(conn)
+	}
+}
+
+func (r *VhostRouter) route(conn net.Conn) {
+	var recorded bytes.Buffer
+	conn.SetReadDeadline(time.Now().Add(vhostSniffTimeout))
+	host, err := r.sniff(bufio.NewReader(io.TeeReader(conn, &recorded)))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		handler.Debugf("%s vhost from %s: %v", r.Name, conn.RemoteAddr().String(), err)
+		r.reject(conn, err)
+		return
+	}
+	l, ok := r.lookup(host)
+	if !ok {
+		handler.Debugf("%s vhost from %s: no service for host %s", r.Name, conn.RemoteAddr().String(), host)
+		r.reject(conn, nil)
+		return
+	}
+	if !l.push(&prefixConn{Conn: conn, prefix: recorded.Bytes()}) {
+		conn.Close()
+	}
+}
+
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+func (r *VhostRouter) lookup(host string) (*vhostListener, bool) {
+	host = normalizeHost(host)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if l, ok := r.routes[host]; ok {
+		return l, true
+	}
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+		if l, ok := r.routes["*."+host]; ok {
+			return l, true
+		}
+	}
+	return nil, false
+}
+
+func (r *VhostRouter) Register(domains []string) (*vhostListener, error) {
+	if len(domains) == 0 {
+		return nil, errNoDomain
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	l := &vhostListener{
+		router:   r,
+		domains:  make([]string, 0, len(domains)),
+		acceptCh: make(chan net.Conn, vhostAcceptSize),
+		closeCh:  make(chan struct{}),
+	}
+	for _, domain := range domains {
+		domain = normalizeHost(domain)
+		if _, ok := r.routes[domain]; ok {
+			return nil, errors.New(domain + ": " + errDomainConflict.Error())
+		}
+		l.domains = append(l.domains, domain)
+	}
+	for _, domain := range l.domains {
+		r.routes[domain] = l
+	}
+	return l, nil
+}
+
+func (r *VhostRouter) unregister(l *vhostListener) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, domain := range l.domains {
+		if r.routes[domain] == l {
+			delete(r.routes, domain)
+		}
+	}
+}
+
+type vhostListener struct {
+	router   *VhostRouter
+	domains  []string
+	acceptCh chan net.Conn
+	closeCh  chan struct{}
+	closed   bool
+	mutex    sync.Mutex
+}
+
+func (l *vhostListener) push(conn net.Conn) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false
+	}
+	select {
+	case l.acceptCh <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *vhostListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.acceptCh:
+		return conn, nil
+	case <-l.closeCh:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *vhostListener) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.closeCh)
+	l.mutex.Unlock()
+	l.router.unregister(l)
+	for {
+		select {
+		case conn := <-l.acceptCh:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (l *vhostListener) Addr() net.Addr {
+	return l.router.listener.Addr()
+}
+
+func (l *vhostListener) Domains() []string {
+	return l.domains
+}
+
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func sniffHTTPHost(r *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return "", err
+	}
+	if req.Host == "" {
+		return "", errVhostNoHostname
+	}
+	return req.Host, nil
+}
+
+func rejectHTTP(conn net.Conn, err error) {
+	status := "404 Not Found"
+	if err != nil {
+		status = "400 Bad Request"
+	}
+	body := status + "\n"
+	fmt.Fprintf(conn, "HTTP/1.1 %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", status, len(body), body)
+	conn.Close()
+}